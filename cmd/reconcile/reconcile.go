@@ -0,0 +1,57 @@
+// Command reconcile backfills rows in the images table for image files that
+// already exist in the configured image store, such as images uploaded before
+// image metadata was stored in Postgres.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/silasburger/lenslocked/models"
+)
+
+var (
+	flags = flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dir   = flags.String("dir", "", "images directory to scan when using the local backend (defaults to IMAGES_DIR)")
+)
+
+func main() {
+	flags.Parse(os.Args[1:])
+
+	pgConfig, err := models.DefaultPostgresConfig()
+	if err != nil {
+		log.Fatalf("reconcile: failed to load Postgres config: %v", err)
+	}
+	storeConfig, err := models.DefaultImageStoreConfig()
+	if err != nil {
+		log.Fatalf("reconcile: failed to load image store config: %v", err)
+	}
+	if *dir != "" {
+		storeConfig.Dir = *dir
+	}
+
+	db, err := models.Open(pgConfig)
+	if err != nil {
+		log.Fatalf("reconcile: failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	store, err := models.NewImageStore(storeConfig)
+	if err != nil {
+		log.Fatalf("reconcile: %v", err)
+	}
+	galleryService := &models.GalleryService{
+		DB:    db,
+		Store: store,
+	}
+	added, skipped, err := galleryService.ReconcileImages()
+	for _, err := range skipped {
+		log.Printf("reconcile: %v", err)
+	}
+	if err != nil {
+		log.Fatalf("reconcile: %v", err)
+	}
+	fmt.Printf("Added %d images.\n", added)
+}
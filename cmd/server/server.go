@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -18,15 +22,47 @@ import (
 )
 
 type config struct {
-	PSQL models.PostgresConfig
-	Mail models.MailConfig
-	CSRF struct {
+	PSQL   models.PostgresConfig
+	Mail   models.MailConfig
+	Images models.ImageStoreConfig
+	CSRF   struct {
 		Key    string
 		Secure bool
 	}
 	Server struct {
 		Address string
 		URL     string
+		// Dev turns on routes that are only meant for development, such as
+		// email previews.
+		Dev bool
+		// TrustedProxies are the addresses of the reverse proxies in front
+		// of the server, whose X-Forwarded-For headers are believed.
+		TrustedProxies []netip.Prefix
+	}
+	TwoFactor struct {
+		// Key encrypts TOTP secrets in the database and must be 32 bytes.
+		Key string
+	}
+	Galleries struct {
+		// Key signs gallery share links and the cookies that unlock
+		// passphrase protected galleries. It must be at least 32 bytes.
+		Key string
+	}
+	RateLimit struct {
+		// Store is "memory" or "postgres". Use postgres when running more
+		// than one server so that limits are shared.
+		Store string
+		// Default applies to every request from an IP address.
+		Default models.RateLimit
+		// Auth applies to sign up, sign in and password reset requests.
+		Auth models.RateLimit
+		// Uploads applies to image uploads by each user.
+		Uploads models.RateLimit
+	}
+	Jobs struct {
+		// Workers is the number of background jobs the server runs at a time.
+		// Set it to 0 to run jobs with cmd/worker instead.
+		Workers int
 	}
 }
 
@@ -37,17 +73,18 @@ func loadEnvConfig() (config, error) {
 		return cfg, err
 	}
 
-	cfg.PSQL = models.PostgresConfig{
-		Host:     os.Getenv("PSQL_HOST"),
-		Port:     os.Getenv("PSQL_PORT"),
-		User:     os.Getenv("PSQL_USER"),
-		Password: os.Getenv("PSQL_PASSWORD"),
-		Database: os.Getenv("PSQL_DATABASE"),
-		SSLMode:  os.Getenv("PSQL_SSL_MODE"),
+	cfg.PSQL, err = models.DefaultPostgresConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Mail, err = models.DefaultMailConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Images, err = models.DefaultImageStoreConfig()
+	if err != nil {
+		return cfg, err
 	}
-
-	cfg.Mail.SendEndpoint = os.Getenv("MAIL_SEND_ENDPOINT")
-	cfg.Mail.Token = os.Getenv("MAIL_TOKEN")
 
 	cfg.CSRF.Key = os.Getenv("CSRF_KEY")
 	secureStr := os.Getenv("CSRF_SECURE")
@@ -57,11 +94,88 @@ func loadEnvConfig() (config, error) {
 	}
 	cfg.CSRF.Secure = secure
 
+	cfg.TwoFactor.Key = os.Getenv("TOTP_KEY")
+	if len(cfg.TwoFactor.Key) != 32 {
+		return cfg, fmt.Errorf("TOTP_KEY must be 32 bytes, got %d", len(cfg.TwoFactor.Key))
+	}
+
+	cfg.Galleries.Key = os.Getenv("GALLERY_KEY")
+	if len(cfg.Galleries.Key) < 32 {
+		return cfg, fmt.Errorf("GALLERY_KEY must be at least 32 bytes, got %d", len(cfg.Galleries.Key))
+	}
+
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
 	cfg.Server.URL = os.Getenv("SERVER_URL")
+	cfg.Server.Dev = os.Getenv("SERVER_DEV") == "true"
+	cfg.Server.TrustedProxies, err = trustedProxiesEnv("TRUSTED_PROXIES")
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.RateLimit.Store = os.Getenv("RATE_LIMIT_STORE")
+	cfg.RateLimit.Default, err = rateLimitEnv("RATE_LIMIT_DEFAULT", "600/1m")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.RateLimit.Auth, err = rateLimitEnv("RATE_LIMIT_AUTH", "10/1m")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.RateLimit.Uploads, err = rateLimitEnv("RATE_LIMIT_UPLOADS", "30/1m")
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Jobs.Workers = 1
+	if workersStr := os.Getenv("JOB_WORKERS"); workersStr != "" {
+		cfg.Jobs.Workers, err = strconv.Atoi(workersStr)
+		if err != nil {
+			return cfg, err
+		}
+	}
 	return cfg, nil
 }
 
+// rateLimitEnv parses the rate limit in the environment variable, or def if it
+// isn't set.
+func rateLimitEnv(key, def string) (models.RateLimit, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		value = def
+	}
+	rate, err := models.ParseRateLimit(value)
+	if err != nil {
+		return rate, fmt.Errorf("%s: %w", key, err)
+	}
+	return rate, nil
+}
+
+// trustedProxiesEnv parses the comma separated IP addresses and CIDR ranges
+// in the environment variable.
+func trustedProxiesEnv(key string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
 func main() {
 	cfg, err := loadEnvConfig()
 	if err != nil {
@@ -98,15 +212,72 @@ func run(cfg config) error {
 		DB:           db,
 		TokenManager: &models.TokenManager{},
 	}
-	pwResetService := &models.PasswordResetService{
+	go sessionService.Sweep(context.Background(), time.Hour)
+	tokenService := &models.OneTimeTokenService{
+		DB:           db,
+		TokenManager: &models.TokenManager{},
+	}
+	go tokenService.Sweep(context.Background(), time.Hour)
+	throttleService := &models.ThrottleService{
 		DB: db,
 	}
+	go throttleService.Sweep(context.Background(), time.Hour)
+	twoFactorService := &models.TwoFactorService{
+		DB:            db,
+		TokenManager:  &models.TokenManager{},
+		EncryptionKey: []byte(cfg.TwoFactor.Key),
+	}
+	apiTokenService := &models.APITokenService{
+		DB:           db,
+		TokenManager: &models.TokenManager{},
+	}
+	shareLinkService := &models.ShareLinkService{
+		DB:  db,
+		Key: []byte(cfg.Galleries.Key),
+	}
+	go shareLinkService.Sweep(context.Background(), time.Hour)
+	memberService := &models.GalleryMemberService{
+		DB:           db,
+		TokenManager: &models.TokenManager{},
+	}
+	go memberService.Sweep(context.Background(), time.Hour)
 
-	mailTrap := &models.MailTrap{SendEndpoint: cfg.Mail.SendEndpoint, Token: cfg.Mail.Token}
-	emailService := models.NewEmailService(mailTrap, cfg.Server.URL)
+	jobService := &models.JobService{
+		DB: db,
+	}
 
+	emailer, err := models.NewEmailer(cfg.Mail)
+	if err != nil {
+		return err
+	}
+	emailService := models.NewEmailService(emailer, cfg.Server.URL)
+	emailService.DB = db
+	emailService.Jobs = jobService
+	// The dev inbox shows the bodies of sent emails.
+	emailService.KeepBodies = cfg.Server.Dev
+	go emailService.Sweep(context.Background(), time.Hour)
+
+	imageStore, err := models.NewImageStore(cfg.Images)
+	if err != nil {
+		return err
+	}
+	userService.Store = imageStore
 	galleriesService := &models.GalleryService{
-		DB: db,
+		DB:        db,
+		Store:     imageStore,
+		Jobs:      jobService,
+		UnlockKey: []byte(cfg.Galleries.Key),
+	}
+
+	// Start background workers
+	if cfg.Jobs.Workers > 0 {
+		worker := &models.Worker{
+			JobService:  jobService,
+			Concurrency: cfg.Jobs.Workers,
+		}
+		worker.Handle(models.JobSendEmail, emailService.SendEmailJob)
+		worker.Handle(models.JobGenerateVariants, galleriesService.GenerateVariantsJob)
+		go worker.Run(context.Background())
 	}
 
 	// Set up middleware
@@ -114,18 +285,52 @@ func run(cfg config) error {
 		[]byte(cfg.CSRF.Key),
 		csrf.Secure(cfg.CSRF.Secure),
 		csrf.Path("/"),
+		csrf.ErrorHandler(http.HandlerFunc(controllers.CSRFFailure)),
 	)
 
 	umw := controllers.UserMiddleware{
 		SessionService: sessionService,
 	}
+	proxyMw := controllers.ProxyMiddleware{
+		TrustedProxies: cfg.Server.TrustedProxies,
+	}
+	atmw := controllers.APITokenMiddleware{
+		APITokenService: apiTokenService,
+		PathPrefix:      "/api/v1/",
+	}
+
+	rateLimitStore, err := models.NewRateLimitStore(cfg.RateLimit.Store, db)
+	if err != nil {
+		return err
+	}
+	go rateLimitStore.Sweep(context.Background(), 10*time.Minute)
+	defaultLimiter := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Rate:  cfg.RateLimit.Default,
+		Name:  "default",
+		Skip:  controllers.StaticRequest,
+	}
+	authLimiter := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Rate:  cfg.RateLimit.Auth,
+		Name:  "auth",
+	}
+	uploadLimiter := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Rate:  cfg.RateLimit.Uploads,
+		Name:  "uploads",
+		Key:   controllers.RateLimitByUser,
+	}
 
 	// Set up controllers
 	usersC := controllers.Users{
-		UsersService:         userService,
-		SessionService:       sessionService,
-		PasswordResetService: pwResetService,
-		EmailService:         emailService,
+		UsersService:     userService,
+		SessionService:   sessionService,
+		TokenService:     tokenService,
+		EmailService:     emailService,
+		TwoFactorService: twoFactorService,
+		ThrottleService:  throttleService,
+		APITokenService:  apiTokenService,
 	}
 	usersC.Templates.SignIn = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "signin.gohtml"))
 	usersC.Templates.New = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "signup.gohtml"))
@@ -135,21 +340,79 @@ func run(cfg config) error {
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "reset-pw.gohtml"))
 	usersC.Templates.PasswordlessSignin = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "passwordless-signin.gohtml"))
 	usersC.Templates.EditEmail = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "edit-email.gohtml"))
+	usersC.Templates.Sessions = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/sessions.gohtml"))
+	usersC.Templates.TwoFactor = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/two-factor.gohtml"))
+	usersC.Templates.TwoFactorSetup = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/two-factor-setup.gohtml"))
+	usersC.Templates.RecoveryCodes = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/recovery-codes.gohtml"))
+	usersC.Templates.APITokens = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/api-tokens.gohtml"))
+	usersC.Templates.APITokenCreated = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/api-token-created.gohtml"))
+	usersC.Templates.TwoFactorSignIn = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "two-factor-signin.gohtml"))
 
 	galleriesC := controllers.Galleries{
-		GalleryService: galleriesService,
+		GalleryService:   galleriesService,
+		UserService:      userService,
+		ShareLinkService: shareLinkService,
+		MemberService:    memberService,
+		EmailService:     emailService,
+		ServerURL:        cfg.Server.URL,
 	}
 	galleriesC.Templates.New = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/new.gohtml"))
 	galleriesC.Templates.Edit = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/edit.gohtml"))
 	galleriesC.Templates.Index = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/index.gohtml"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/show.gohtml"))
+	galleriesC.Templates.Unlock = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/unlock.gohtml"))
+	galleriesC.Templates.Invitation = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "galleries/invitation.gohtml"))
+
+	profilesC := controllers.Profiles{
+		UserService:    userService,
+		GalleryService: galleriesService,
+	}
+	profilesC.Templates.Show = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/profile.gohtml"))
+	profilesC.Templates.Edit = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "users/edit-profile.gohtml"))
+
+	apiC := controllers.API{
+		GalleryService: galleriesService,
+		MemberService:  memberService,
+	}
 
 	// Set up router and routes
+	api := chi.NewRouter()
+	api.Use(apiC.CSRFToken)
+	api.NotFound(apiC.NotFound)
+	api.MethodNotAllowed(apiC.MethodNotAllowed)
+	api.Get("/openapi.json", apiC.OpenAPI)
+	api.Group(func(r chi.Router) {
+		r.Use(apiC.RequireUser)
+		r.Get("/me", apiC.CurrentUser)
+		read := apiC.RequireScope(models.ScopeReadGalleries)
+		write := apiC.RequireScope(models.ScopeWriteGalleries)
+		upload := apiC.RequireScope(models.ScopeUploadImages)
+		r.With(read).Get("/galleries", apiC.Galleries)
+		r.With(write).Post("/galleries", apiC.CreateGallery)
+		r.With(read).Get("/galleries/{id}", apiC.Gallery)
+		r.With(write).Patch("/galleries/{id}", apiC.UpdateGallery)
+		r.With(write).Delete("/galleries/{id}", apiC.DeleteGallery)
+		r.With(read).Get("/galleries/{id}/images", apiC.Images)
+		r.With(upload, uploadLimiter.Limit).Post("/galleries/{id}/images", apiC.UploadImage)
+		r.With(write).Delete("/galleries/{id}/images/{filename}", apiC.DeleteImage)
+	})
+	err = apiC.CheckSpec(api)
+	if err != nil {
+		return err
+	}
+
 	r := chi.NewRouter()
 
+	r.Use(proxyMw.RealIP)
+	// The logger comes right after the client's address is known, so that
+	// requests turned away by the middleware below are logged too.
+	r.Use(middleware.Logger)
+	// API tokens are checked before CSRF, which is skipped for requests that
+	// use one. They are only accepted by the API.
+	r.Use(atmw.SetUser)
 	r.Use(csrfMw)
 	r.Use(umw.SetUser)
-	r.Use(middleware.Logger)
+	r.Use(defaultLimiter.Limit)
 
 	tpl := views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "home.gohtml"))
 	r.Get("/", controllers.StaticHandler(tpl))
@@ -162,32 +425,56 @@ func run(cfg config) error {
 
 	r.Get("/signup", usersC.New)
 
-	r.Post("/signup", usersC.Create)
+	r.With(authLimiter.Limit).Post("/signup", usersC.Create)
 
 	r.Get("/signin", usersC.SignIn)
 
-	r.Post("/signin", usersC.ProcessSignIn)
+	r.With(authLimiter.Limit).Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/two-factor", usersC.TwoFactorSignIn)
+	r.With(authLimiter.Limit).Post("/signin/two-factor", usersC.ProcessTwoFactorSignIn)
 	r.Post("/signout", usersC.ProcessSignOut)
 
 	r.Get("/forgot-pw", usersC.ForgotPassword)
-	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
+	r.With(authLimiter.Limit).Post("/forgot-pw", usersC.ProcessForgotPassword)
 
 	r.Get("/reset-pw", usersC.ResetPassword)
-	r.Post("/reset-pw", usersC.ProcessResetPassword)
+	r.With(authLimiter.Limit).Post("/reset-pw", usersC.ProcessResetPassword)
 
 	r.Get("/passwordless-signin", usersC.PasswordlessSignin)
-	r.Post("/passwordless-signin", usersC.ProcessPasswordlessSignin)
+	r.With(authLimiter.Limit).Post("/passwordless-signin", usersC.ProcessPasswordlessSignin)
 
 	r.Get("/email-signin", usersC.ProcessEmailSignin)
 
+	r.Get("/verify-email", usersC.ProcessVerifyEmail)
+
 	tpl = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "greeting.gohtml"))
 	r.Get("/greeting", controllers.StaticHandler(tpl))
 
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Post("/verify-email", usersC.ResendVerification)
+		r.Get("/sessions", usersC.Sessions)
+		r.Post("/sessions/revoke-others", usersC.RevokeOtherSessions)
+		r.Post("/sessions/{id}/delete", usersC.RevokeSession)
+		r.Get("/two-factor", usersC.TwoFactor)
+		r.Post("/two-factor/setup", usersC.SetupTwoFactor)
+		r.Post("/two-factor/enable", usersC.EnableTwoFactor)
+		r.Post("/two-factor/disable", usersC.DisableTwoFactor)
+		r.Post("/two-factor/recovery-codes", usersC.RegenerateRecoveryCodes)
+		r.Get("/tokens", usersC.APITokens)
+		r.Post("/tokens", usersC.CreateAPIToken)
+		r.Post("/tokens/{id}/delete", usersC.RevokeAPIToken)
+		r.Get("/profile", profilesC.Edit)
+		r.Post("/profile", profilesC.Update)
+		r.With(uploadLimiter.Limit).Post("/profile/avatar", profilesC.UploadAvatar)
+		r.Post("/profile/avatar/delete", profilesC.DeleteAvatar)
 	})
 
+	r.Get("/u/{slug}", profilesC.Show)
+	r.Get("/u/{slug}/avatar", profilesC.Avatar)
+	r.Get("/u/{slug}/{gallerySlug}", galleriesC.ShowBySlug)
+
 	r.Route("/users/edit-email", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.EditEmail)
@@ -197,6 +484,7 @@ func run(cfg config) error {
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesC.Show)
 		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.With(authLimiter.Limit).Post("/{id}/unlock", galleriesC.Unlock)
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
 			r.Get("/", galleriesC.Index)
@@ -205,11 +493,44 @@ func run(cfg config) error {
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
 			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Post("/{id}/images/{filename}", galleriesC.UpdateImage)
 			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
-			r.Post("/{id}/images", galleriesC.UploadImage)
+			r.Post("/{id}/order", galleriesC.ReorderImages)
+			r.Post("/{id}/cover", galleriesC.SetCover)
+			r.Post("/{id}/passphrase", galleriesC.SetPassphrase)
+			r.Post("/{id}/passphrase/delete", galleriesC.RemovePassphrase)
+			r.Post("/{id}/share-links", galleriesC.CreateShareLink)
+			r.Post("/{id}/share-links/{linkID}/delete", galleriesC.RevokeShareLink)
+			r.Post("/{id}/invitations", galleriesC.Invite)
+			r.Post("/{id}/invitations/{invitationID}/delete", galleriesC.RevokeInvitation)
+			r.Post("/{id}/members/{userID}", galleriesC.UpdateMember)
+			r.Post("/{id}/members/{userID}/delete", galleriesC.RemoveMember)
+			r.Post("/{id}/members/{userID}/transfer", galleriesC.TransferOwnership)
+			r.With(uploadLimiter.Limit).Post("/{id}/images", galleriesC.UploadImage)
 		})
 	})
 
+	r.Get("/invitations", galleriesC.Invitation)
+	r.With(umw.RequireUser).Post("/invitations", galleriesC.AcceptInvitation)
+
+	if cfg.Server.Dev {
+		devC := controllers.Dev{
+			EmailService: emailService,
+		}
+		devC.Templates.Emails = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "dev/emails.gohtml"))
+		devC.Templates.Inbox = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "dev/inbox.gohtml"))
+		devC.Templates.InboxEmail = views.Must(views.ParseFS(templates.FS, "tailwind.gohtml", "dev/inbox-email.gohtml"))
+		r.Route("/dev", func(r chi.Router) {
+			r.Get("/emails", devC.Emails)
+			r.Get("/emails/{name}", devC.Email)
+			r.Get("/inbox", devC.Inbox)
+			r.Get("/inbox/{id}", devC.InboxEmail)
+			r.Get("/inbox/{id}/html", devC.InboxEmailHTML)
+		})
+	}
+
+	r.Mount("/api/v1", api)
+
 	assetsHandler := http.FileServer(http.Dir("assets"))
 	r.Get("/assets/*", http.StripPrefix("/assets", assetsHandler).ServeHTTP)
 
@@ -0,0 +1,107 @@
+// Command worker runs background jobs, such as sending emails and generating
+// image variants, separately from the web server. Run the server with
+// JOB_WORKERS=0 when using it.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/joho/godotenv"
+	"github.com/silasburger/lenslocked/models"
+)
+
+type config struct {
+	PSQL   models.PostgresConfig
+	Mail   models.MailConfig
+	Images models.ImageStoreConfig
+	Server struct {
+		URL string
+		Dev bool
+	}
+}
+
+var (
+	flags       = flag.NewFlagSet("worker", flag.ExitOnError)
+	concurrency = flags.Int("concurrency", 2, "number of jobs to run at a time")
+)
+
+func loadEnvConfig() (config, error) {
+	var cfg config
+	err := godotenv.Load()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.PSQL, err = models.DefaultPostgresConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Images, err = models.DefaultImageStoreConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Mail, err = models.DefaultMailConfig()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Server.URL = os.Getenv("SERVER_URL")
+	cfg.Server.Dev = os.Getenv("SERVER_DEV") == "true"
+	return cfg, nil
+}
+
+func main() {
+	flags.Parse(os.Args[1:])
+	cfg, err := loadEnvConfig()
+	if err != nil {
+		log.Fatalf("worker: failed to load config: %v", err)
+	}
+	err = run(cfg)
+	if err != nil {
+		log.Fatalf("worker: %v", err)
+	}
+}
+
+func run(cfg config) error {
+	db, err := models.Open(cfg.PSQL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	jobService := &models.JobService{
+		DB: db,
+	}
+	emailer, err := models.NewEmailer(cfg.Mail)
+	if err != nil {
+		return err
+	}
+	emailService := models.NewEmailService(emailer, cfg.Server.URL)
+	emailService.DB = db
+	// The dev inbox shows the bodies of sent emails.
+	emailService.KeepBodies = cfg.Server.Dev
+	imageStore, err := models.NewImageStore(cfg.Images)
+	if err != nil {
+		return err
+	}
+	galleryService := &models.GalleryService{
+		DB:    db,
+		Store: imageStore,
+	}
+
+	worker := &models.Worker{
+		JobService:  jobService,
+		Concurrency: *concurrency,
+	}
+	worker.Handle(models.JobSendEmail, emailService.SendEmailJob)
+	worker.Handle(models.JobGenerateVariants, galleryService.GenerateVariantsJob)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Starting %d workers...", *concurrency)
+	worker.Run(ctx)
+	return nil
+}
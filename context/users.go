@@ -9,7 +9,8 @@ import (
 type key string
 
 const (
-	userKey key = "user"
+	userKey     key = "user"
+	apiTokenKey key = "api-token"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -28,3 +29,16 @@ func User(ctx context.Context) *models.User {
 	}
 	return user
 }
+
+// WithAPIToken records that the request was authenticated with an API token
+// rather than a session.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+// APIToken returns the API token the request was authenticated with, or nil
+// if it wasn't.
+func APIToken(ctx context.Context) *models.APIToken {
+	token, _ := ctx.Value(apiTokenKey).(*models.APIToken)
+	return token
+}
@@ -0,0 +1,537 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/csrf"
+	"github.com/silasburger/lenslocked/context"
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+const (
+	apiDefaultLimit = 20
+	apiMaxLimit     = 100
+	// apiMaxBodySize caps JSON request bodies. Image uploads are multipart
+	// forms and are limited separately.
+	apiMaxBodySize = 1 << 20 // 1mb
+)
+
+// API serves the JSON API mounted at /api/v1. Its routes are described by the
+// OpenAPI document in openapi.json, which CheckSpec compares against the
+// router at startup.
+type API struct {
+	GalleryService *models.GalleryService
+	MemberService  *models.GalleryMemberService
+}
+
+// apiError is the envelope every API error is sent in:
+//
+//	{"error": {"code": "not_found", "message": "Resource not found."}}
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAPIUnauthorized = apiError{http.StatusUnauthorized, "unauthorized", "You must be signed in."}
+	errAPIForbidden    = apiError{http.StatusForbidden, "forbidden", "You are not authorized to access this resource."}
+	errAPINotFound     = apiError{http.StatusNotFound, "not_found", "Resource not found."}
+)
+
+type apiUser struct {
+	ID            int    `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+type apiGallery struct {
+	// ID is the gallery's public ID, which can't be counted through like
+	// its sequential one.
+	ID             string                `json:"id"`
+	UserID         int                   `json:"user_id"`
+	Slug           string                `json:"slug"`
+	Title          string                `json:"title"`
+	Visibility     models.Visibility     `json:"visibility"`
+	ShowLocation   bool                  `json:"show_location"`
+	MetadataPolicy models.MetadataPolicy `json:"metadata_policy"`
+}
+
+type apiImage struct {
+	ID          int               `json:"id"`
+	GalleryID   string            `json:"gallery_id"`
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Size        int64             `json:"size"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	Position    int               `json:"position"`
+	Title       string            `json:"title"`
+	Caption     string            `json:"caption"`
+	AltText     string            `json:"alt_text"`
+	URL         string            `json:"url"`
+	Variants    []apiImageVariant `json:"variants"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+type apiImageVariant struct {
+	Size   string `json:"size"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+type apiPagination struct {
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	Total  int `json:"total"`
+}
+
+// apiPage is the envelope of every list response.
+type apiPage[T any] struct {
+	Data       []T           `json:"data"`
+	Pagination apiPagination `json:"pagination"`
+}
+
+func newAPIGallery(gallery models.Gallery) apiGallery {
+	return apiGallery{
+		ID:             gallery.PublicID,
+		UserID:         gallery.UserID,
+		Slug:           gallery.Slug,
+		Title:          gallery.Title,
+		Visibility:     gallery.Visibility,
+		ShowLocation:   gallery.ShowLocation,
+		MetadataPolicy: gallery.MetadataPolicy,
+	}
+}
+
+func newAPIImage(gallery *models.Gallery, image models.Image) apiImage {
+	src := galleryPath(gallery.PublicID) + "/images/" + url.PathEscape(image.Filename)
+	variants := []apiImageVariant{}
+	for _, variant := range image.Variants() {
+		variants = append(variants, apiImageVariant{
+			Size:   variant.Size,
+			Width:  variant.Width,
+			Height: variant.Height,
+			URL:    src + "?size=" + variant.Size,
+		})
+	}
+	return apiImage{
+		ID:          image.ID,
+		GalleryID:   gallery.PublicID,
+		Filename:    image.Filename,
+		ContentType: image.ContentType,
+		Size:        image.Size,
+		Width:       image.Width,
+		Height:      image.Height,
+		Position:    image.Position,
+		Title:       image.Title,
+		Caption:     image.Caption,
+		AltText:     image.AltText,
+		URL:         src,
+		Variants:    variants,
+		CreatedAt:   image.CreatedAt,
+	}
+}
+
+// RequireUser responds with 401 Unauthorized, rather than redirecting to the
+// sign in page, when there is no signed in user.
+func (a API) RequireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.User(r.Context()) == nil {
+			writeAPIError(w, errAPIUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken sends the CSRF token in the X-CSRF-Token header of every
+// response. Clients authenticated by the session cookie must echo it back in
+// the same header on POST, PATCH and DELETE requests.
+func (a API) CSRFToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NotFound and MethodNotAllowed keep unknown routes in the JSON envelope.
+func (a API) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, apiError{http.StatusNotFound, "not_found", "Route not found."})
+}
+
+func (a API) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, apiError{http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed."})
+}
+
+// CSRFFailure is the error handler for the CSRF middleware. API requests get
+// a JSON error; everything else gets the middleware's usual plain text one.
+func CSRFFailure(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, apiError{http.StatusForbidden, "csrf_invalid", "The CSRF token is missing or invalid."})
+		return
+	}
+	http.Error(w, fmt.Sprintf("%s - %s", http.StatusText(http.StatusForbidden), csrf.FailureReason(r)),
+		http.StatusForbidden)
+}
+
+func (a API) CurrentUser(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	writeJSON(w, http.StatusOK, apiUser{
+		ID:            user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified(),
+	})
+}
+
+func (a API) Galleries(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := apiPaging(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	user := context.User(r.Context())
+	galleries, total, err := a.GalleryService.ByUserIDPage(user.ID, limit, offset)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	page := apiPage[apiGallery]{
+		Data:       []apiGallery{},
+		Pagination: apiPagination{Limit: limit, Offset: offset, Total: total},
+	}
+	for _, gallery := range galleries {
+		page.Data = append(page.Data, newAPIGallery(gallery))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (a API) CreateGallery(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title string `json:"title"`
+	}
+	err := readJSON(w, r, &input)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if strings.TrimSpace(input.Title) == "" {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "title is required."})
+		return
+	}
+	user := context.User(r.Context())
+	gallery, err := a.GalleryService.Create(input.Title, user.ID, models.VisibilityPrivate)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/galleries/"+gallery.PublicID)
+	writeJSON(w, http.StatusCreated, newAPIGallery(*gallery))
+}
+
+func (a API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, models.RoleViewer)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIGallery(*gallery))
+}
+
+// UpdateGallery changes the fields present in the request body and leaves the
+// rest as they are.
+func (a API) UpdateGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, models.RoleEditor)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var input struct {
+		Title          *string `json:"title"`
+		Visibility     *string `json:"visibility"`
+		ShowLocation   *bool   `json:"show_location"`
+		MetadataPolicy *string `json:"metadata_policy"`
+	}
+	err = readJSON(w, r, &input)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if input.Title != nil {
+		if strings.TrimSpace(*input.Title) == "" {
+			writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "title can't be empty."})
+			return
+		}
+		gallery.Title = *input.Title
+	}
+	if input.Visibility != nil {
+		visibility, err := models.ParseVisibility(*input.Visibility)
+		if err != nil {
+			writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request",
+				"visibility must be private, unlisted or public."})
+			return
+		}
+		gallery.Visibility = visibility
+	}
+	if input.ShowLocation != nil {
+		gallery.ShowLocation = *input.ShowLocation
+	}
+	if input.MetadataPolicy != nil {
+		policy, err := models.ParseMetadataPolicy(*input.MetadataPolicy)
+		if err != nil {
+			writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request",
+				"metadata_policy must be keep, strip_location or strip_all."})
+			return
+		}
+		gallery.MetadataPolicy = policy
+	}
+	user := context.User(r.Context())
+	if !gallery.Private() && !user.EmailVerified() {
+		writeAPIError(w, apiError{http.StatusForbidden, "email_unverified",
+			"Please verify your email address before sharing galleries."})
+		return
+	}
+	err = a.GalleryService.Update(gallery)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIGallery(*gallery))
+}
+
+func (a API) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, models.RoleOwner)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	err = a.GalleryService.Delete(gallery.ID)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, models.RoleViewer)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	limit, offset, err := apiPaging(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	images, total, err := a.GalleryService.ImagesPage(gallery.ID, limit, offset)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	page := apiPage[apiImage]{
+		Data:       []apiImage{},
+		Pagination: apiPagination{Limit: limit, Offset: offset, Total: total},
+	}
+	for _, image := range images {
+		page.Data = append(page.Data, newAPIImage(gallery, image))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// UploadImage accepts a multipart form with one or more files in the "images"
+// field, the same as the gallery edit page, and responds with the images that
+// were created.
+func (a API) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, models.RoleContributor)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	err = r.ParseMultipartForm(5 << 20) // 5mb
+	if err != nil {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request",
+			"The request must be a multipart form with files in the images field."})
+		return
+	}
+	user := context.User(r.Context())
+	fileHeaders := r.MultipartForm.File["images"]
+	if len(fileHeaders) == 0 {
+		writeAPIError(w, apiError{http.StatusBadRequest, "invalid_request", "No images were uploaded."})
+		return
+	}
+	created := []apiImage{}
+	for _, fileHeader := range fileHeaders {
+		file, err := fileHeader.Open()
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		image, err := a.GalleryService.CreateImage(gallery.ID, user.ID, fileHeader.Filename, file)
+		// Closed right away rather than deferred, so that uploads of many
+		// files don't keep all of them open.
+		file.Close()
+		if err != nil {
+			var fileError models.FileError
+			if errors.As(err, &fileError) {
+				msg := fmt.Sprintf("%v has an invalid content type or extension, or is too large. Only png, gif, and jpg files of at most %d megapixels can be uploaded.", fileHeader.Filename, models.MaxImagePixels/1_000_000)
+				writeAPIError(w, apiError{http.StatusBadRequest, "invalid_file", msg})
+				return
+			}
+			writeAPIError(w, err)
+			return
+		}
+		created = append(created, newAPIImage(gallery, *image))
+	}
+	writeJSON(w, http.StatusCreated, struct {
+		Data []apiImage `json:"data"`
+	}{created})
+}
+
+func (a API) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.gallery(r, models.RoleEditor)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	filename := filepath.Base(chi.URLParam(r, "filename"))
+	_, err = a.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	err = a.GalleryService.DeleteImage(gallery.ID, filename)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// gallery looks up the gallery with the public ID in the URL and checks that
+// the user's role in it includes role. Public and unlisted galleries without a
+// passphrase can also be read by any signed in user, but private galleries are
+// hidden from users who are not members.
+func (a API) gallery(r *http.Request, role models.GalleryRole) (*models.Gallery, error) {
+	gallery, err := a.GalleryService.ByPublicID(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, err
+	}
+	user := context.User(r.Context())
+	userRole, err := a.MemberService.Role(gallery, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if userRole.Includes(role) {
+		return gallery, nil
+	}
+	if !userRole.Includes(models.RoleViewer) {
+		if gallery.Private() {
+			// Don't reveal that the gallery exists.
+			return nil, errAPINotFound
+		}
+		if gallery.Protected() {
+			return nil, apiError{http.StatusForbidden, "forbidden", "This gallery is protected by a passphrase."}
+		}
+		if role == models.RoleViewer {
+			return gallery, nil
+		}
+	}
+	return nil, errAPIForbidden
+}
+
+// apiPaging reads the limit and offset query parameters.
+func apiPaging(r *http.Request) (limit, offset int, err error) {
+	limit = apiDefaultLimit
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > apiMaxLimit {
+			return 0, 0, apiError{http.StatusBadRequest, "invalid_request",
+				fmt.Sprintf("limit must be a number from 1 to %d.", apiMaxLimit)}
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, apiError{http.StatusBadRequest, "invalid_request",
+				"offset must be a number of at least 0."}
+		}
+	}
+	return limit, offset, nil
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, apiMaxBodySize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		msg := "The request body must be a JSON object."
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+			msg = "The request body is not valid JSON."
+		case errors.As(err, &typeErr):
+			msg = fmt.Sprintf("%s has the wrong type.", typeErr.Field)
+		case errors.As(err, &maxBytesErr):
+			msg = "The request body is too large."
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			msg = fmt.Sprintf("Unknown field %s.", strings.TrimPrefix(err.Error(), "json: unknown field "))
+		}
+		return apiError{http.StatusBadRequest, "invalid_request", msg}
+	}
+	if dec.More() {
+		return apiError{http.StatusBadRequest, "invalid_request", "The request body must be a single JSON object."}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// writeAPIError maps err to a status code and an error envelope. Errors from
+// the models package get their matching status, public errors keep their
+// message, and anything else is logged and reported as an internal error.
+func writeAPIError(w http.ResponseWriter, err error) {
+	var apiErr apiError
+	var pubErr interface{ Public() string }
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.Is(err, models.ErrNotFound):
+		apiErr = errAPINotFound
+	case errors.Is(err, models.ErrEmailTaken):
+		apiErr = apiError{http.StatusConflict, "conflict", "That email address is already associated with an account."}
+	case errors.As(err, &pubErr):
+		apiErr = apiError{http.StatusBadRequest, "invalid_request", pubErr.Public()}
+	default:
+		fmt.Println(err)
+		apiErr = apiError{http.StatusInternalServerError, "internal_error", "Something went wrong."}
+	}
+	writeJSON(w, apiErr.Status, struct {
+		Error apiError `json:"error"`
+	}{apiErr})
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPI serves the OpenAPI document that describes the API.
+func (a API) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// CheckSpec compares the routes registered on the API router with the paths
+// and operations in the OpenAPI document, and returns an error listing any
+// that are missing from either. It keeps the document from drifting out of
+// date as endpoints are added or changed.
+func (a API) CheckSpec(routes chi.Routes) error {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		return fmt.Errorf("check openapi spec: %w", err)
+	}
+	documented := make(map[string]bool)
+	for path, item := range spec.Paths {
+		for method := range item {
+			switch method {
+			case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	registered := make(map[string]bool)
+	err = chi.Walk(routes, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		registered[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("check openapi spec: %w", err)
+	}
+	var problems []string
+	for op := range registered {
+		if !documented[op] {
+			problems = append(problems, op+" is not documented")
+		}
+	}
+	for op := range documented {
+		if !registered[op] {
+			problems = append(problems, op+" is documented but has no route")
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("check openapi spec: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/csrf"
+	"github.com/silasburger/lenslocked/context"
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+// apiTokenExpiries are the lifetimes offered when creating an API token. A
+// zero lifetime never expires.
+var apiTokenExpiries = []struct {
+	Days  int
+	Label string
+}{
+	{30, "30 days"},
+	{90, "90 days"},
+	{365, "1 year"},
+	{0, "Never"},
+}
+
+// APITokenMiddleware authenticates requests that carry an API token in an
+// "Authorization: Bearer" header. It must run before the CSRF middleware.
+type APITokenMiddleware struct {
+	APITokenService *models.APITokenService
+	// PathPrefix is where the API is served. Tokens sent to any other path
+	// are ignored, since the rest of the site doesn't check their scopes.
+	PathPrefix string
+}
+
+// SetUser sets the token's user on the request and skips the CSRF check for
+// it. Browsers never add an Authorization header to cross-site requests on
+// their own, so requests authenticated this way can't be forged. Requests
+// with a bad token are rejected rather than treated as signed out, so clients
+// find out their token no longer works.
+func (atm APITokenMiddleware) SetUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, atm.PathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		apiToken, user, err := atm.APITokenService.Authenticate(strings.TrimSpace(token))
+		if err != nil {
+			if !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrAPITokenExpired) {
+				fmt.Println(err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeAPIError(w, apiError{http.StatusUnauthorized, "unauthorized",
+				"The API token is invalid or has expired."})
+			return
+		}
+		ctx := r.Context()
+		ctx = context.WithUser(ctx, user)
+		ctx = context.WithAPIToken(ctx, apiToken)
+		r = r.WithContext(ctx)
+		r = csrf.UnsafeSkipCheck(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope responds with 403 Forbidden to requests authenticated with an
+// API token that wasn't granted the scope. Requests authenticated with a
+// session can do anything the user can.
+func (a API) RequireScope(scope models.APIScope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := context.APIToken(r.Context())
+			if token != nil && !token.HasScope(scope) {
+				writeAPIError(w, apiError{http.StatusForbidden, "insufficient_scope",
+					fmt.Sprintf("The API token needs the %s scope.", scope)})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (u Users) APITokens(w http.ResponseWriter, r *http.Request) {
+	u.renderAPITokens(w, r)
+}
+
+func (u Users) renderAPITokens(w http.ResponseWriter, r *http.Request, errs ...error) {
+	type Token struct {
+		ID         int
+		Name       string
+		Scopes     []models.APIScope
+		CreatedAt  time.Time
+		LastUsedAt *time.Time
+		ExpiresAt  *time.Time
+		Expired    bool
+	}
+	var data struct {
+		Tokens   []Token
+		Scopes   []models.APIScope
+		Expiries []struct {
+			Days  int
+			Label string
+		}
+		Name string
+	}
+	data.Scopes = models.APIScopes
+	data.Expiries = apiTokenExpiries
+	data.Name = r.PostFormValue("name")
+	user := context.User(r.Context())
+	tokens, err := u.APITokenService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	for _, token := range tokens {
+		data.Tokens = append(data.Tokens, Token{
+			ID:         token.ID,
+			Name:       token.Name,
+			Scopes:     token.Scopes,
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: token.LastUsedAt,
+			ExpiresAt:  token.ExpiresAt,
+			Expired:    token.ExpiresAt != nil && now.After(*token.ExpiresAt),
+		})
+	}
+	u.Templates.APITokens.Execute(w, r, data, errs...)
+}
+
+// CreateAPIToken creates a token and shows it to the user. This is the only
+// time the token can be seen.
+func (u Users) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	name := r.PostForm.Get("name")
+	if strings.TrimSpace(name) == "" {
+		err = errors.Public(fmt.Errorf("create api token: missing name"),
+			"Please give the token a name.")
+		u.renderAPITokens(w, r, err)
+		return
+	}
+	var scopes []models.APIScope
+	for _, scope := range r.PostForm["scopes"] {
+		if !slices.Contains(models.APIScopes, models.APIScope(scope)) {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		scopes = append(scopes, models.APIScope(scope))
+	}
+	if len(scopes) == 0 {
+		err = errors.Public(fmt.Errorf("create api token: no scopes"),
+			"Please choose at least one permission for the token.")
+		u.renderAPITokens(w, r, err)
+		return
+	}
+	var expiresAt *time.Time
+	days, err := strconv.Atoi(r.PostForm.Get("expires"))
+	if err != nil || days < 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if days > 0 {
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+	user := context.User(r.Context())
+	token, err := u.APITokenService.Create(user.ID, name, scopes, expiresAt)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Name  string
+		Token string
+	}
+	data.Name = token.Name
+	data.Token = token.Token
+	u.Templates.APITokenCreated.Execute(w, r, data)
+}
+
+func (u Users) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = u.APITokenService.Delete(user.ID, tokenID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/tokens", http.StatusFound)
+}
@@ -3,6 +3,9 @@ package controllers
 import (
 	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/silasburger/lenslocked/models"
 )
 
 const (
@@ -24,6 +27,19 @@ func setCookie(w http.ResponseWriter, name string, value string) {
 	http.SetCookie(w, cookie)
 }
 
+// setSessionCookie stores the session token in a cookie. Persistent sessions
+// get a cookie that expires with the session, others get a browser-session
+// cookie that is removed when the browser is closed.
+func setSessionCookie(w http.ResponseWriter, session *models.Session) {
+	cookie := newCookie(CookieSession, session.Token)
+	cookie.SameSite = http.SameSiteLaxMode
+	if session.Persistent {
+		cookie.Expires = session.ExpiresAt
+		cookie.MaxAge = int(time.Until(session.ExpiresAt).Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
+
 func readCookie(r *http.Request, name string) (string, error) {
 	c, err := r.Cookie(name)
 	if err != nil {
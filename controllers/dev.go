@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+// Dev has pages that help during development. Its routes must never be
+// mounted in production.
+type Dev struct {
+	Templates struct {
+		Emails     Template
+		Inbox      Template
+		InboxEmail Template
+	}
+	EmailService *models.EmailService
+}
+
+// Emails shows a preview of every email the app sends.
+func (d Dev) Emails(w http.ResponseWriter, r *http.Request) {
+	type Email struct {
+		Name    string
+		Subject string
+	}
+	var data struct {
+		Emails []Email
+	}
+	for _, name := range d.EmailService.EmailPreviews() {
+		email, err := d.EmailService.PreviewEmail(name)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		data.Emails = append(data.Emails, Email{
+			Name:    name,
+			Subject: email.Subject,
+		})
+	}
+	d.Templates.Emails.Execute(w, r, data)
+}
+
+// Email renders a single email with sample data, as HTML or, with
+// ?format=text, as plain text.
+func (d Dev) Email(w http.ResponseWriter, r *http.Request) {
+	email, err := d.EmailService.PreviewEmail(chi.URLParam(r, "name"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Email not found", http.StatusNotFound)
+			return
+		}
+		// Template errors are what designers need to see while iterating.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "From: %s\nTo: %s\nSubject: %s\n\n", email.From, email.To, email.Subject)
+		io.WriteString(w, email.Text)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, email.HTML)
+}
+
+// Inbox lists the emails in the outbox, so that flows such as resetting a
+// password can be tested without a mail provider.
+func (d Dev) Inbox(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Emails []models.OutboxEmail
+	}
+	emails, err := d.EmailService.RecentEmails(100)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Emails = emails
+	d.Templates.Inbox.Execute(w, r, data)
+}
+
+func (d Dev) InboxEmail(w http.ResponseWriter, r *http.Request) {
+	email, err := d.outboxEmail(w, r)
+	if err != nil {
+		return
+	}
+	d.Templates.InboxEmail.Execute(w, r, email)
+}
+
+// InboxEmailHTML renders the HTML body of an email from the outbox on its own,
+// to be shown in an iframe.
+func (d Dev) InboxEmailHTML(w http.ResponseWriter, r *http.Request) {
+	email, err := d.outboxEmail(w, r)
+	if err != nil {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, email.HTML)
+}
+
+func (d Dev) outboxEmail(w http.ResponseWriter, r *http.Request) (*models.OutboxEmail, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+	email, err := d.EmailService.OutboxEmail(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Email not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	return email, nil
+}
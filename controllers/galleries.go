@@ -2,11 +2,14 @@ package controllers
 
 import (
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/silasburger/lenslocked/context"
@@ -16,12 +19,20 @@ import (
 
 type Galleries struct {
 	Templates struct {
-		New   Template
-		Edit  Template
-		Index Template
-		Show  Template
-	}
-	GalleryService *models.GalleryService
+		New        Template
+		Edit       Template
+		Index      Template
+		Show       Template
+		Unlock     Template
+		Invitation Template
+	}
+	GalleryService   *models.GalleryService
+	UserService      *models.UserService
+	ShareLinkService *models.ShareLinkService
+	MemberService    *models.GalleryMemberService
+	EmailService     *models.EmailService
+	// ServerURL is used to build share links and invitation links.
+	ServerURL string
 }
 
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
@@ -35,138 +46,457 @@ func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
 func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
 	var data struct {
-		UserID    int
-		Title     string
-		Published bool
+		UserID     int
+		Title      string
+		Visibility models.Visibility
 	}
 	data.UserID = user.ID
 	data.Title = r.FormValue("title")
-	data.Published = false
-	gallery, err := g.GalleryService.Create(data.Title, data.UserID, data.Published)
+	data.Visibility = models.VisibilityPrivate
+	if strings.TrimSpace(data.Title) == "" {
+		err := errors.Public(fmt.Errorf("create gallery: empty title"),
+			"Please give the gallery a title.")
+		g.Templates.New.Execute(w, r, data, err)
+		return
+	}
+	gallery, err := g.GalleryService.Create(data.Title, data.UserID, data.Visibility)
 	if err != nil {
 		g.Templates.New.Execute(w, r, data, err)
 		return
 	}
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
 	if err != nil {
 		return
 	}
+	g.renderEdit(w, r, gallery)
+}
+
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
 	type Image struct {
-		GalleryID       int
+		GalleryID       string
 		Filename        string
 		FilenameEscaped string
-	}
-	var data struct {
+		SrcSet          string
+		Title           string
+		Caption         string
+		AltText         string
+		Alt             string
+		IsCover         bool
+	}
+	type ShareLink struct {
 		ID        int
-		Title     string
-		Published bool
-		Images    []Image
+		URL       string
+		CreatedAt time.Time
+		ExpiresAt *time.Time
+		MaxViews  *int
+		Views     int
 	}
-	data.ID = gallery.ID
+	var data struct {
+		ID               string
+		URL              string
+		Title            string
+		Visibility       models.Visibility
+		Visibilities     []models.Visibility
+		ShowLocation     bool
+		MetadataPolicy   models.MetadataPolicy
+		MetadataPolicies []metadataPolicyOption
+		Protected        bool
+		UserID           int
+		Role             models.GalleryRole
+		CanEdit          bool
+		IsOwner          bool
+		Images           []Image
+		MaxTitle         int
+		MaxCaption       int
+		MaxAltText       int
+		ShareLinks       []ShareLink
+		ShareExpiries    []shareLinkExpiry
+		Members          []models.GalleryMember
+		Invitations      []models.GalleryInvitation
+		Roles            []models.GalleryRole
+	}
+	data.ID = gallery.PublicID
 	data.Title = gallery.Title
-	data.Published = gallery.Published
+	data.Visibility = gallery.Visibility
+	data.Visibilities = models.Visibilities
+	data.ShowLocation = gallery.ShowLocation
+	data.MetadataPolicy = gallery.MetadataPolicy
+	data.MetadataPolicies = metadataPolicyOptions
+	data.Protected = gallery.Protected()
+	data.ShareExpiries = shareLinkExpiries
+	data.Roles = models.GalleryRoles
+	data.MaxTitle = models.MaxImageTitleLength
+	data.MaxCaption = models.MaxImageCaptionLength
+	data.MaxAltText = models.MaxImageAltTextLength
+	role, err := g.role(r, gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	canonicalPath, err := g.canonicalGalleryPath(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.URL = g.ServerURL + canonicalPath
+	data.UserID = context.User(r.Context()).ID
+	data.Role = role
+	data.CanEdit = role.Includes(models.RoleEditor)
+	data.IsOwner = role.Includes(models.RoleOwner)
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	cover := gallery.CoverFrom(images)
 	for _, image := range images {
 		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
+			GalleryID:       gallery.PublicID,
 			Filename:        image.Filename,
 			FilenameEscaped: url.PathEscape(image.Filename),
+			SrcSet:          imageSrcSet(gallery, image, ""),
+			Title:           image.Title,
+			Caption:         image.Caption,
+			AltText:         image.AltText,
+			Alt:             image.Alt(),
+			IsCover:         image.ID == cover.ID,
 		})
 	}
-	g.Templates.Edit.Execute(w, r, data)
+	if data.CanEdit {
+		links, err := g.ShareLinkService.ByGalleryID(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		for _, link := range links {
+			data.ShareLinks = append(data.ShareLinks, ShareLink{
+				ID:        link.ID,
+				URL:       g.shareURL(gallery.PublicID, link.Token),
+				CreatedAt: link.CreatedAt,
+				ExpiresAt: link.ExpiresAt,
+				MaxViews:  link.MaxViews,
+				Views:     link.Views,
+			})
+		}
+	}
+	data.Members, err = g.MemberService.Members(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if data.IsOwner {
+		data.Invitations, err = g.MemberService.Invitations(gallery.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
 	if err != nil {
 		return
 	}
 	gallery.Title = r.FormValue("title")
-	if r.FormValue("published") == "" {
-		gallery.Published = false
-	} else if r.FormValue("published") == "true" {
-		gallery.Published = true
+	if strings.TrimSpace(gallery.Title) == "" {
+		err = errors.Public(fmt.Errorf("update gallery: empty title"),
+			"Please give the gallery a title.")
+		g.renderEdit(w, r, gallery, err)
+		return
+	}
+	visibility, err := models.ParseVisibility(r.FormValue("visibility"))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	if visibility != models.VisibilityPrivate && !user.EmailVerified() {
+		err = errors.Public(fmt.Errorf("share gallery: unverified email"),
+			"Please verify your email address before sharing galleries.")
+		g.renderEdit(w, r, gallery, err)
+		return
+	}
+	gallery.Visibility = visibility
+	gallery.ShowLocation = r.FormValue("show_location") == "true"
+	gallery.MetadataPolicy, err = models.ParseMetadataPolicy(r.FormValue("metadata_policy"))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
 	}
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID        int
-		Title     string
-		Published bool
+		ID         string
+		Title      string
+		Visibility models.Visibility
+		Role       models.GalleryRole
+		CoverSrc   string
+		CoverAlt   string
 	}
 	var data struct {
+		UserID    int
 		Galleries []Gallery
+		Shared    []Gallery
 	}
 	user := context.User(r.Context())
-	galleries, err := g.GalleryService.ByUserID(user.ID)
+	data.UserID = user.ID
+	galleries, err := g.GalleryService.ByUserIDWithCovers(user.ID)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
 	for _, gallery := range galleries {
-		data.Galleries = append(data.Galleries, Gallery{ID: gallery.ID, Title: gallery.Title, Published: gallery.Published})
+		entry := Gallery{ID: gallery.PublicID, Title: gallery.Title, Visibility: gallery.Visibility, Role: models.RoleOwner}
+		entry.CoverSrc, entry.CoverAlt = coverThumb(&gallery.Gallery, gallery.Cover)
+		data.Galleries = append(data.Galleries, entry)
+	}
+	shared, err := g.MemberService.Shared(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range shared {
+		entry := Gallery{ID: gallery.PublicID, Title: gallery.Title, Visibility: gallery.Visibility, Role: gallery.Role}
+		entry.CoverSrc, entry.CoverAlt = coverThumb(&gallery.Gallery, gallery.Cover)
+		data.Shared = append(data.Shared, entry)
 	}
 	g.Templates.Index.Execute(w, r, data)
 }
 
+// coverThumb returns the path of the thumbnail of the gallery's cover and
+// its alt text, or empty strings if the gallery has no cover.
+func coverThumb(gallery *models.Gallery, cover *models.Image) (src, alt string) {
+	if cover == nil {
+		return "", ""
+	}
+	return imageURL(gallery, *cover, models.ImageSizeThumb, ""), cover.Alt()
+}
+
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, mustOwnUnpublishedGallery)
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	// Public galleries live on the owner's profile.
+	canonicalPath, err := g.canonicalGalleryPath(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if canonicalPath != galleryPath(gallery.PublicID) {
+		// Temporary, since the gallery moves back if it stops being
+		// public.
+		redirectKeepingQuery(w, r, canonicalPath, http.StatusFound)
+		return
+	}
+	g.show(w, r, gallery)
+}
+
+// ShowBySlug shows a public gallery at its address on the owner's profile,
+// /u/{slug}/{gallerySlug}. Old profile and gallery slugs are redirected to the
+// current ones.
+func (g Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	user, err := g.UserService.BySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	gallery, err := g.GalleryService.BySlug(user.ID, models.NormalizeSlug(chi.URLParam(r, "gallerySlug")))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// Slugs are easy to guess, so other galleries can only be found by
+	// their public ID.
+	if !gallery.Listed() {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return
+	}
+	canonicalPath, err := g.canonicalGalleryPath(gallery)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if canonicalPath != r.URL.Path {
+		// Old slugs are gone for good, but the gallery only leaves the
+		// owner's profile while they have none.
+		code := http.StatusMovedPermanently
+		if canonicalPath == galleryPath(gallery.PublicID) {
+			code = http.StatusFound
+		}
+		redirectKeepingQuery(w, r, canonicalPath, code)
+		return
+	}
+	g.show(w, r, gallery)
+}
+
+// redirectKeepingQuery redirects to path with the query of the request, which
+// may have a share link in it.
+func redirectKeepingQuery(w http.ResponseWriter, r *http.Request, path string, code int) {
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, path, code)
+}
+
+// canonicalGalleryPath is the path a gallery is viewed at: on the owner's
+// profile for public galleries, and under its public ID for the rest, or if
+// the owner has no profile.
+func (g Galleries) canonicalGalleryPath(gallery *models.Gallery) (string, error) {
+	if !gallery.Listed() {
+		return galleryPath(gallery.PublicID), nil
+	}
+	owner, err := g.UserService.ByID(gallery.UserID)
+	if err != nil {
+		return "", fmt.Errorf("canonical gallery path: %w", err)
+	}
+	if owner.Slug == "" {
+		return galleryPath(gallery.PublicID), nil
+	}
+	return galleryProfilePath(owner.Slug, gallery.Slug), nil
+}
+
+func (g Galleries) show(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	err := g.canViewGallery(true)(w, r, gallery)
 	if err != nil {
 		return
 	}
+	noIndex(w, gallery)
+	// Images in a gallery viewed with a share link need the link's token to
+	// load too.
+	share := r.URL.Query().Get("share")
 	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+		Href    string
+		Src     string
+		SrcSet  string
+		Alt     string
+		Title   string
+		Caption string
+		Info    []metadataField
+	}
+	// Preview describes the gallery to sites that show a preview of links
+	// to it.
+	type Preview struct {
+		URL      string
+		Image    string
+		ImageAlt string
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID      string
+		Title   string
+		Images  []Image
+		Preview *Preview
 	}
-	data.ID = gallery.ID
+	data.ID = gallery.PublicID
 	data.Title = gallery.Title
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	metadata, err := g.GalleryService.Metadata(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// Where photos were taken can give away where people live, so only
+	// editors see it unless the gallery chooses to show it.
+	showLocation := gallery.ShowLocation
+	if !showLocation {
+		role, err := g.role(r, gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		showLocation = role.Includes(models.RoleEditor)
+	}
 	for _, image := range images {
 		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
+			Href:    imageURL(gallery, image, "", share),
+			Src:     imageURL(gallery, image, "medium", share),
+			SrcSet:  imageSrcSet(gallery, image, share),
+			Alt:     image.Alt(),
+			Title:   image.Title,
+			Caption: image.Caption,
+			Info:    metadataFields(metadata[image.ID], showLocation),
 		})
 	}
+	// Previews are left out for galleries that not everyone with the link
+	// can see, so that their cover isn't shown to whoever the link is
+	// posted to.
+	if !gallery.Private() && !gallery.Protected() {
+		data.Preview = &Preview{
+			URL: g.ServerURL + r.URL.Path,
+		}
+		if cover := gallery.CoverFrom(images); cover != nil {
+			data.Preview.Image = g.ServerURL + imageURL(gallery, *cover, models.ImageSizeLarge, "")
+			data.Preview.ImageAlt = cover.Alt()
+		}
+	}
 	g.Templates.Show.Execute(w, r, data)
 }
 
+// noIndex asks search engines not to index galleries that aren't public.
+func noIndex(w http.ResponseWriter, gallery *models.Gallery) {
+	if !gallery.Listed() {
+		w.Header().Set("X-Robots-Tag", "noindex")
+	}
+}
+
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(w, r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryByID(w, r, g.canViewGallery(false))
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
-	image, err := g.GalleryService.Image(galleryID, filename)
+	noIndex(w, gallery)
+	image, err := g.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found.", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	contents, info, err := g.GalleryService.OpenImage(image, r.FormValue("size"))
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			http.Error(w, "Image not found.", http.StatusNotFound)
@@ -176,12 +506,81 @@ func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	http.ServeFile(w, r, image.Path)
+	defer contents.Close()
+	if info.Key == image.Key && gallery.MetadataPolicy != models.MetadataKeep {
+		// The owner gets different bytes than everyone else, so shared
+		// caches mustn't keep either.
+		w.Header().Set("Cache-Control", "private")
+	}
+	strip, err := g.stripsMetadata(r, gallery, image, info)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if strip {
+		serveStrippedImage(w, contents, image, info, gallery.MetadataPolicy)
+		return
+	}
+	serveImage(w, r, image.Filename, contents, info)
+}
+
+// imageSrcSet builds the srcset attribute listing every resized variant of the
+// image along with the original, so browsers can pick the smallest one that
+// fits. share is the share link token the gallery is being viewed with, if
+// any.
+func imageSrcSet(gallery *models.Gallery, image models.Image, share string) string {
+	var candidates []string
+	for _, variant := range image.Variants() {
+		candidates = append(candidates, fmt.Sprintf("%s %dw", imageURL(gallery, image, variant.Size, share), variant.Width))
+	}
+	candidates = append(candidates, fmt.Sprintf("%s %dw", imageURL(gallery, image, "", share), image.Width))
+	return strings.Join(candidates, ", ")
+}
+
+// imageURL is the path of the image in the gallery, or of one of its variants
+// if size is set.
+func imageURL(gallery *models.Gallery, image models.Image, size, share string) string {
+	src := galleryPath(gallery.PublicID) + "/images/" + url.PathEscape(image.Filename)
+	query := url.Values{}
+	if size != "" {
+		query.Set("size", size)
+	}
+	if share != "" {
+		query.Set("share", share)
+	}
+	if len(query) == 0 {
+		return src
+	}
+	return src + "?" + query.Encode()
+}
+
+// serveImage writes the image contents to the response. Seekable contents,
+// such as files from the local disk, go through http.ServeContent so that
+// range and conditional requests keep working.
+func serveImage(w http.ResponseWriter, r *http.Request, name string, contents io.Reader, info models.ObjectInfo) {
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	if rs, ok := contents.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, name, info.ModTime, rs)
+		return
+	}
+	if !info.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	}
+	if info.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	_, err := io.Copy(w, contents)
+	if err != nil {
+		fmt.Println(err)
+	}
 }
 
 func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	filename := g.filename(w, r)
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
 	if err != nil {
 		return
 	}
@@ -189,12 +588,12 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 	}
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
 	if err != nil {
 		return
 	}
@@ -208,15 +607,16 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
 
+// galleryByID looks up the gallery with the public ID in the URL.
 func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
-	id, err := strconv.Atoi(chi.URLParam(r, "id"))
-	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
-	}
-	gallery, err := g.GalleryService.ByID(id)
+	id := chi.URLParam(r, "id")
+	gallery, err := g.GalleryService.ByPublicID(id)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
-			http.Error(w, "Gallery not found", http.StatusInternalServerError)
+			if g.redirectSequentialID(w, r, id) {
+				return nil, err
+			}
+			http.Error(w, "Gallery not found", http.StatusNotFound)
 			return nil, err
 		}
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -231,26 +631,125 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	return gallery, err
 }
 
-func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
-	fmt.Println(r.Context())
+// redirectSequentialID redirects links from before galleries had public IDs,
+// which used their sequential ID, to the same page under the gallery's public
+// ID. Public galleries are redirected for everyone, since they are listed
+// anyway. Others are only redirected for members and visitors with an active
+// share link, so that counting through IDs doesn't turn up unlisted
+// galleries. It reports whether a redirect was sent.
+func (g Galleries) redirectSequentialID(w http.ResponseWriter, r *http.Request, id string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	galleryID, err := strconv.Atoi(id)
+	if err != nil {
+		return false
+	}
+	gallery, err := g.GalleryService.ByID(galleryID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		return false
+	}
+	if !gallery.Listed() {
+		role, err := g.role(r, gallery)
+		if err != nil {
+			fmt.Println(err)
+			return false
+		}
+		if !role.Includes(models.RoleViewer) {
+			share := r.URL.Query().Get("share")
+			if share == "" || g.ShareLinkService.Use(gallery.ID, share, false) != nil {
+				return false
+			}
+		}
+	}
+	redirectKeepingQuery(w, r, galleryPath(gallery.PublicID)+strings.TrimPrefix(r.URL.Path, galleryPath(id)), http.StatusMovedPermanently)
+	return true
+}
+
+// userMustHaveRole rejects users whose role in the gallery does not include
+// role. Use models.RoleOwner for actions only the owner can take.
+func (g Galleries) userMustHaveRole(role models.GalleryRole) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		userRole, err := g.role(r, gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return err
+		}
+		if !userRole.Includes(role) {
+			http.Error(w, "You are not authorized to access this gallery", http.StatusForbidden)
+			return fmt.Errorf("user does not have the %s role in this gallery", role)
+		}
+		return nil
+	}
+}
+
+// role is the signed in user's role in the gallery. It is empty for visitors
+// who are not signed in or not members.
+func (g Galleries) role(r *http.Request, gallery *models.Gallery) (models.GalleryRole, error) {
 	user := context.User(r.Context())
-	if user.ID != gallery.UserID {
-		http.Error(w, "You are not authorized to access this gallery", http.StatusForbidden)
-		return fmt.Errorf("user does not have access to this gallery")
+	if user == nil {
+		return "", nil
 	}
-	return nil
+	return g.MemberService.Role(gallery, user.ID)
 }
 
-func mustOwnUnpublishedGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
-	if !gallery.Published {
-		user := context.User(r.Context())
-		if user == nil {
+// canViewGallery decides who can view a gallery and its images. Public and
+// unlisted galleries are open to everyone, unless they are protected by a
+// passphrase that visitors must enter first. Private galleries can only be
+// viewed by their owner and members. An active share link token in the share
+// query parameter grants access to either.
+//
+// page is set for the gallery page itself: visits count toward the share
+// link's view limit, and visitors to a locked gallery are asked for its
+// passphrase rather than turned away.
+func (g Galleries) canViewGallery(page bool) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		if !gallery.Private() && !gallery.Protected() {
+			return nil
+		}
+		role, err := g.role(r, gallery)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return err
+		}
+		if role.Includes(models.RoleViewer) {
+			return nil
+		}
+		if share := r.URL.Query().Get("share"); share != "" {
+			err := g.ShareLinkService.Use(gallery.ID, share, page)
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrShareLinkExpired) {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return err
+			}
+			if gallery.Private() {
+				http.Error(w, "This share link has expired or been revoked.", http.StatusForbidden)
+				return err
+			}
+			// A protected gallery can still be unlocked with its passphrase.
+		}
+		if gallery.Private() {
 			http.Error(w, "You are not authorized to access this gallery", http.StatusForbidden)
-			return fmt.Errorf("unauthorized to access unpublished gallery")
+			return fmt.Errorf("unauthorized to access private gallery")
+		}
+		if g.unlocked(r, gallery) {
+			return nil
 		}
-		return userMustOwnGallery(w, r, gallery)
+		if page {
+			g.renderUnlock(w, r, gallery)
+		} else {
+			http.Error(w, "This gallery is protected by a passphrase.", http.StatusForbidden)
+		}
+		return fmt.Errorf("gallery %s is locked", gallery.PublicID)
 	}
-	return nil
 }
 
 func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
@@ -260,7 +759,7 @@ func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
 }
 
 func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleContributor))
 	if err != nil {
 		return
 	}
@@ -269,27 +768,31 @@ func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	user := context.User(r.Context())
 	fileHeaders := r.MultipartForm.File["images"]
 	for _, fileHeader := range fileHeaders {
 		file, err := fileHeader.Open()
 		if err != nil {
-			var fileError models.FileError
-			if errors.As(err, fileError) {
-				msg := fmt.Sprintf("%v has an invalid content type or extension. Only png, gif, and jpg files can be uploaded.", fileHeader.Filename)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
-			}
 			fmt.Println(err)
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			return
 		}
-		defer file.Close()
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		_, err = g.GalleryService.CreateImage(gallery.ID, user.ID, fileHeader.Filename, file)
+		// Closed right away rather than deferred, so that uploads of many
+		// files don't keep all of them open.
+		file.Close()
 		if err != nil {
+			var fileError models.FileError
+			if errors.As(err, &fileError) {
+				msg := fmt.Sprintf("%v has an invalid content type or extension, or is too large. Only png, gif, and jpg files of at most %d megapixels can be uploaded.", fileHeader.Filename, models.MaxImagePixels/1_000_000)
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			fmt.Println(err)
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			return
 		}
 	}
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/silasburger/lenslocked/context"
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+// Invite emails an invitation to join the gallery to the address in the form.
+func (g Galleries) Invite(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
+	if err != nil {
+		return
+	}
+	role, err := models.ParseGalleryRole(r.FormValue("role"))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	user := context.User(r.Context())
+	// Invitations are emailed to any address, so they are held back until
+	// the owner has shown that their own address is real.
+	if !user.EmailVerified() {
+		err = errors.Public(fmt.Errorf("invite gallery member: unverified email"),
+			"Please verify your email address before inviting people to galleries.")
+		g.renderEdit(w, r, gallery, err)
+		return
+	}
+	invitation, err := g.MemberService.Invite(gallery, user.ID, email, role)
+	if err != nil {
+		if errors.Is(err, models.ErrAlreadyMember) {
+			err = errors.Public(err, "That person is already a member of this gallery.")
+			g.renderEdit(w, r, gallery, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals := url.Values{
+		"token": {invitation.Token},
+	}
+	acceptURL := g.ServerURL + "/invitations?" + vals.Encode()
+	err = g.EmailService.GalleryInvitation(invitation.Email, user.Email, gallery.Title, role, acceptURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
+	if err != nil {
+		return
+	}
+	invitationID, err := strconv.Atoi(chi.URLParam(r, "invitationID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.MemberService.RevokeInvitation(gallery.ID, invitationID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Invitation not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Invitation shows the invitation in the token query parameter, with a button
+// to accept it once the visitor is signed in.
+func (g Galleries) Invitation(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token        string
+		GalleryTitle string
+		Email        string
+		Role         models.GalleryRole
+		SignedIn     bool
+		// SignedInEmail is the address of the signed in user, if it isn't
+		// the one the invitation was sent to.
+		SignedInEmail string
+	}
+	data.Token = r.FormValue("token")
+	invitation, err := g.MemberService.Invitation(data.Token)
+	if err != nil {
+		g.invitationError(w, err)
+		return
+	}
+	data.GalleryTitle = invitation.GalleryTitle
+	data.Email = invitation.Email
+	data.Role = invitation.Role
+	if user := context.User(r.Context()); user != nil {
+		data.SignedIn = true
+		if !strings.EqualFold(user.Email, invitation.Email) {
+			data.SignedInEmail = user.Email
+		}
+	}
+	g.Templates.Invitation.Execute(w, r, data)
+}
+
+// AcceptInvitation makes the signed in user a member of the gallery the
+// invitation is for.
+func (g Galleries) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	invitation, err := g.MemberService.Accept(r.FormValue("token"), user)
+	if err != nil {
+		if errors.Is(err, models.ErrAlreadyMember) {
+			// The owner accepted an invitation to their own gallery. There
+			// is nothing to join, so take them to their galleries.
+			http.Redirect(w, r, "/galleries", http.StatusFound)
+			return
+		}
+		if errors.Is(err, models.ErrInvitationEmail) {
+			http.Error(w, "This invitation was sent to a different email address. Sign in with that address to accept it.", http.StatusForbidden)
+			return
+		}
+		g.invitationError(w, err)
+		return
+	}
+	http.Redirect(w, r, galleryPath(invitation.GalleryPublicID), http.StatusFound)
+}
+
+func (g Galleries) invitationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "This invitation is invalid or has been revoked.", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, models.ErrTokenExpired) {
+		http.Error(w, "This invitation has expired.", http.StatusBadRequest)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, "Something went wrong", http.StatusInternalServerError)
+}
+
+// UpdateMember changes the role of one of the gallery's members.
+func (g Galleries) UpdateMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
+	if err != nil {
+		return
+	}
+	userID, ok := memberID(w, r)
+	if !ok {
+		return
+	}
+	role, err := models.ParseGalleryRole(r.FormValue("role"))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	err = g.MemberService.SetRole(gallery.ID, userID, role)
+	if err != nil {
+		g.memberError(w, err)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// RemoveMember takes a member out of the gallery. The owner can remove anyone,
+// and members can remove themselves to leave the gallery.
+func (g Galleries) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleViewer))
+	if err != nil {
+		return
+	}
+	userID, ok := memberID(w, r)
+	if !ok {
+		return
+	}
+	user := context.User(r.Context())
+	if userID != user.ID && user.ID != gallery.UserID {
+		http.Error(w, "You are not authorized to access this gallery", http.StatusForbidden)
+		return
+	}
+	err = g.MemberService.Remove(gallery.ID, userID)
+	if err != nil {
+		g.memberError(w, err)
+		return
+	}
+	if userID == user.ID {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// TransferOwnership hands the gallery over to one of its members. The old
+// owner stays on as an editor.
+func (g Galleries) TransferOwnership(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleOwner))
+	if err != nil {
+		return
+	}
+	userID, ok := memberID(w, r)
+	if !ok {
+		return
+	}
+	err = g.MemberService.TransferOwnership(gallery.ID, gallery.UserID, userID)
+	if err != nil {
+		g.memberError(w, err)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func memberID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return 0, false
+	}
+	return userID, true
+}
+
+func (g Galleries) memberError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrNotFound) {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	fmt.Println(err)
+	http.Error(w, "Something went wrong", http.StatusInternalServerError)
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+const (
+	// CookieGalleryUnlock holds the unlock token of a passphrase protected
+	// gallery. Each gallery gets its own cookie, named after its public ID.
+	// The cookies aren't scoped to the gallery's path because public
+	// galleries are also viewed on the owner's profile.
+	CookieGalleryUnlock = "gallery_unlock"
+
+	// maxPassphraseLength is the most bcrypt can hash.
+	maxPassphraseLength = 72
+)
+
+func galleryPath(publicID string) string {
+	return "/galleries/" + publicID
+}
+
+func unlockCookieName(gallery *models.Gallery) string {
+	return CookieGalleryUnlock + "_" + gallery.PublicID
+}
+
+// unlocked reports whether the visitor entered the gallery's passphrase.
+func (g Galleries) unlocked(r *http.Request, gallery *models.Gallery) bool {
+	token, err := readCookie(r, unlockCookieName(gallery))
+	if err != nil {
+		return false
+	}
+	return g.GalleryService.Unlocked(gallery, token)
+}
+
+func (g Galleries) renderUnlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	var data struct {
+		ID    string
+		Title string
+	}
+	data.ID = gallery.PublicID
+	data.Title = gallery.Title
+	g.Templates.Unlock.Execute(w, r, data, errs...)
+}
+
+// Unlock checks the passphrase of a protected gallery and, if it is right,
+// sets a cookie that lets the visitor view the gallery and its images.
+func (g Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	if gallery.Private() || !gallery.Protected() {
+		http.Redirect(w, r, galleryPath(gallery.PublicID), http.StatusFound)
+		return
+	}
+	err = g.GalleryService.CheckPassphrase(gallery, r.FormValue("passphrase"))
+	if err != nil {
+		if errors.Is(err, models.ErrPasswordMismatch) {
+			err = errors.Public(err, "That passphrase is not correct.")
+		}
+		g.renderUnlock(w, r, gallery, err)
+		return
+	}
+	token, expiresAt := g.GalleryService.UnlockToken(gallery)
+	cookie := newCookie(unlockCookieName(gallery), token)
+	cookie.SameSite = http.SameSiteLaxMode
+	cookie.Expires = expiresAt
+	cookie.MaxAge = int(time.Until(expiresAt).Seconds())
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, galleryPath(gallery.PublicID), http.StatusFound)
+}
+
+// SetPassphrase protects the gallery with a new passphrase, replacing any it
+// already had. Visitors who unlocked it with the old one have to enter the new
+// one.
+func (g Galleries) SetPassphrase(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	passphrase := r.FormValue("passphrase")
+	if passphrase == "" || len(passphrase) > maxPassphraseLength {
+		err = errors.Public(fmt.Errorf("set gallery passphrase: invalid length %d", len(passphrase)),
+			fmt.Sprintf("The passphrase must be between 1 and %d characters long.", maxPassphraseLength))
+		g.renderEdit(w, r, gallery, err)
+		return
+	}
+	err = g.GalleryService.SetPassphrase(gallery.ID, passphrase)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) RemovePassphrase(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.SetPassphrase(gallery.ID, "")
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
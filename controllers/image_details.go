@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+// UpdateImage saves the title, caption and alt text of one of the gallery's
+// images.
+func (g Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	filename := g.filename(w, r)
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	details := models.ImageDetails{
+		Title:   strings.TrimSpace(r.FormValue("title")),
+		Caption: strings.TrimSpace(r.FormValue("caption")),
+		AltText: strings.TrimSpace(r.FormValue("alt_text")),
+	}
+	for _, field := range []struct {
+		name  string
+		value string
+		max   int
+	}{
+		{"title", details.Title, models.MaxImageTitleLength},
+		{"caption", details.Caption, models.MaxImageCaptionLength},
+		{"alt text", details.AltText, models.MaxImageAltTextLength},
+	} {
+		if utf8.RuneCountInString(field.value) > field.max {
+			err = errors.Public(fmt.Errorf("update image: %s too long", field.name),
+				fmt.Sprintf("An image's %s can be at most %d characters long.", field.name, field.max))
+			g.renderEdit(w, r, gallery, err)
+			return
+		}
+	}
+	err = g.GalleryService.UpdateImageDetails(gallery.ID, filename, details)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found.", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// ReorderImages puts the gallery's images in the order of the filename form
+// values. The edit page sends it when images are dragged to a new place.
+func (g Galleries) ReorderImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	err = g.GalleryService.ReorderImages(gallery.ID, r.PostForm["filename"])
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// SetCover makes the image in the filename form value the gallery's cover, or
+// goes back to using the first image if it is empty.
+func (g Galleries) SetCover(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.SetCover(gallery.ID, r.FormValue("filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found.", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/silasburger/lenslocked/models"
+)
+
+// metadataField is one line of an image's info panel.
+type metadataField struct {
+	Label string
+	Value string
+	// URL links the value somewhere, such as a map of where the photo was
+	// taken.
+	URL string
+}
+
+// metadataFields formats what the camera recorded about a photo for the
+// info panel. The location is only included if showLocation is set.
+func metadataFields(meta models.ImageMetadata, showLocation bool) []metadataField {
+	var fields []metadataField
+	add := func(label, value string) {
+		if value != "" {
+			fields = append(fields, metadataField{Label: label, Value: value})
+		}
+	}
+	add("Camera", cameraName(meta.CameraMake, meta.CameraModel))
+	add("Lens", meta.LensModel)
+	if meta.FocalLength > 0 {
+		add("Focal length", formatDecimal(meta.FocalLength, 0)+" mm")
+	}
+	if meta.FNumber > 0 {
+		add("Aperture", "ƒ/"+formatDecimal(meta.FNumber, 1))
+	}
+	if meta.ExposureTime > 0 {
+		add("Shutter speed", exposureTime(meta.ExposureTime))
+	}
+	if meta.ISO > 0 {
+		add("ISO", strconv.Itoa(meta.ISO))
+	}
+	if !meta.CapturedAt.IsZero() {
+		add("Taken", meta.CapturedAt.Format("January 2, 2006 3:04 PM"))
+	}
+	if showLocation && meta.Location != nil {
+		lat, lng := meta.Location.Latitude, meta.Location.Longitude
+		fields = append(fields, metadataField{
+			Label: "Location",
+			Value: fmt.Sprintf("%.5f, %.5f", lat, lng),
+			URL:   fmt.Sprintf("https://www.openstreetmap.org/?mlat=%.5f&mlon=%.5f#map=15/%.5f/%.5f", lat, lng, lat, lng),
+		})
+	}
+	return fields
+}
+
+// cameraName joins the camera's make and model. Models often start with the
+// brand already, as in "NIKON CORPORATION" and "NIKON D750", in which case the
+// make is left off.
+func cameraName(cameraMake, model string) string {
+	brand, _, _ := strings.Cut(cameraMake, " ")
+	if brand == "" || strings.HasPrefix(strings.ToLower(model), strings.ToLower(brand)) {
+		return model
+	}
+	if model == "" {
+		return cameraMake
+	}
+	return cameraMake + " " + model
+}
+
+// exposureTime formats an exposure in seconds the way cameras show it, as a
+// fraction of a second when it is shorter than one.
+func exposureTime(seconds float64) string {
+	if seconds < 1 {
+		return fmt.Sprintf("1/%d s", int(math.Round(1/seconds)))
+	}
+	return formatDecimal(seconds, 1) + " s"
+}
+
+// formatDecimal rounds f to at most the number of decimals, leaving off
+// trailing zeros.
+func formatDecimal(f float64, decimals int) string {
+	scale := math.Pow(10, float64(decimals))
+	return strconv.FormatFloat(math.Round(f*scale)/scale, 'f', -1, 64)
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/silasburger/lenslocked/models"
+)
+
+type metadataPolicyOption struct {
+	Policy models.MetadataPolicy
+	Label  string
+}
+
+// metadataPolicyOptions are the metadata policies offered on the edit page.
+var metadataPolicyOptions = []metadataPolicyOption{
+	{models.MetadataKeep, "Keep all metadata"},
+	{models.MetadataStripLocation, "Remove the location"},
+	{models.MetadataStripAll, "Remove all metadata"},
+}
+
+// stripsMetadata reports whether the image being served needs metadata
+// removed first: it is a JPEG or PNG original, the gallery's policy removes
+// something, and the viewer isn't the owner, who always gets the untouched
+// original. Metadata is only removed from JPEGs and PNGs, so GIFs are served
+// as they are.
+func (g Galleries) stripsMetadata(r *http.Request, gallery *models.Gallery, image models.Image, info models.ObjectInfo) (bool, error) {
+	if info.Key != image.Key || gallery.MetadataPolicy == models.MetadataKeep {
+		return false, nil
+	}
+	if image.ContentType != "image/jpeg" && image.ContentType != "image/png" {
+		return false, nil
+	}
+	role, err := g.role(r, gallery)
+	if err != nil {
+		return false, err
+	}
+	return !role.Includes(models.RoleOwner), nil
+}
+
+// serveStrippedImage serves an image without the metadata the policy removes.
+// Its size isn't known until it has been written, so unlike serveImage it
+// can't answer range requests.
+func serveStrippedImage(w http.ResponseWriter, contents io.Reader, image models.Image, info models.ObjectInfo, policy models.MetadataPolicy) {
+	sw := &startedWriter{w: w, contentType: image.ContentType, info: info}
+	err := models.StripMetadata(sw, contents, image.ContentType, policy)
+	if err != nil {
+		fmt.Println(err)
+		if !sw.started {
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+	}
+}
+
+// startedWriter sets the headers of a stripped image when the first bytes of
+// it are written, so that the response can still be an error until then.
+type startedWriter struct {
+	w           http.ResponseWriter
+	contentType string
+	info        models.ObjectInfo
+	started     bool
+}
+
+func (sw *startedWriter) Write(p []byte) (int, error) {
+	if !sw.started {
+		sw.started = true
+		sw.w.Header().Set("Content-Type", sw.contentType)
+		if !sw.info.ModTime.IsZero() {
+			sw.w.Header().Set("Last-Modified", sw.info.ModTime.UTC().Format(http.TimeFormat))
+		}
+	}
+	return sw.w.Write(p)
+}
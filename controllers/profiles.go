@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/silasburger/lenslocked/context"
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+// Profiles serves users' public portfolio pages at /u/{slug} and lets users
+// edit their own.
+type Profiles struct {
+	Templates struct {
+		Show Template
+		Edit Template
+	}
+	UserService    *models.UserService
+	GalleryService *models.GalleryService
+}
+
+func (p Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	user, err := p.userBySlug(w, r)
+	if err != nil {
+		return
+	}
+	type Gallery struct {
+		URL       string
+		Title     string
+		Protected bool
+		Src       string
+		SrcSet    string
+		Alt       string
+	}
+	var data struct {
+		Slug      string
+		Name      string
+		Bio       string
+		AvatarURL string
+		Galleries []Gallery
+	}
+	data.Slug = user.Slug
+	data.Name = user.Name()
+	data.Bio = user.Bio
+	data.AvatarURL = avatarURL(user)
+	galleries, err := p.GalleryService.ListedByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		g := Gallery{
+			URL:       galleryProfilePath(user.Slug, gallery.Slug),
+			Title:     gallery.Title,
+			Protected: gallery.Protected(),
+		}
+		if gallery.Cover != nil {
+			g.Src = imageURL(&gallery.Gallery, *gallery.Cover, models.ImageSizeMedium, "")
+			g.SrcSet = imageSrcSet(&gallery.Gallery, *gallery.Cover, "")
+			g.Alt = gallery.Cover.Alt()
+		}
+		data.Galleries = append(data.Galleries, g)
+	}
+	p.Templates.Show.Execute(w, r, data)
+}
+
+func (p Profiles) Avatar(w http.ResponseWriter, r *http.Request) {
+	user, err := p.userBySlug(w, r)
+	if err != nil {
+		return
+	}
+	contents, info, err := p.UserService.OpenAvatar(user)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "Avatar not found.", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer contents.Close()
+	serveImage(w, r, path.Base(user.AvatarKey), contents, info)
+}
+
+// userBySlug looks up the user whose profile is at the slug in the URL. Old
+// slugs are permanently redirected to the same page under the user's current
+// slug.
+func (p Profiles) userBySlug(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	slug := chi.URLParam(r, "slug")
+	user, err := p.UserService.BySlug(slug)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Profile not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	if user.Slug != slug {
+		target := profilePath(user.Slug) + strings.TrimPrefix(r.URL.Path, profilePath(slug))
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return nil, fmt.Errorf("profile %q moved to %q", slug, user.Slug)
+	}
+	return user, nil
+}
+
+func (p Profiles) Edit(w http.ResponseWriter, r *http.Request) {
+	user, err := p.UserService.ByID(context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	p.renderEdit(w, r, user)
+}
+
+func (p Profiles) renderEdit(w http.ResponseWriter, r *http.Request, user *models.User, errs ...error) {
+	var data struct {
+		Slug                 string
+		DisplayName          string
+		Bio                  string
+		HasAvatar            bool
+		AvatarURL            string
+		ProfileURL           string
+		MaxSlugLength        int
+		MaxDisplayNameLength int
+		MaxBioLength         int
+	}
+	data.Slug = user.Slug
+	data.DisplayName = user.DisplayName
+	data.Bio = user.Bio
+	data.HasAvatar = user.AvatarKey != ""
+	data.AvatarURL = avatarURL(user)
+	if user.Slug != "" {
+		data.ProfileURL = profilePath(user.Slug)
+	}
+	data.MaxSlugLength = models.MaxSlugLength
+	data.MaxDisplayNameLength = models.MaxDisplayNameLength
+	data.MaxBioLength = models.MaxBioLength
+	p.Templates.Edit.Execute(w, r, data, errs...)
+}
+
+func (p Profiles) Update(w http.ResponseWriter, r *http.Request) {
+	user, err := p.UserService.ByID(context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	profile := models.Profile{
+		Slug:        models.NormalizeSlug(r.FormValue("slug")),
+		DisplayName: strings.TrimSpace(r.FormValue("display_name")),
+		Bio:         strings.TrimSpace(r.FormValue("bio")),
+	}
+	// Show what was typed if it can't be saved.
+	user.Slug = profile.Slug
+	user.DisplayName = profile.DisplayName
+	user.Bio = profile.Bio
+	if utf8.RuneCountInString(profile.DisplayName) > models.MaxDisplayNameLength {
+		err = errors.Public(fmt.Errorf("update profile: display name too long"),
+			fmt.Sprintf("Your display name can be at most %d characters long.", models.MaxDisplayNameLength))
+		p.renderEdit(w, r, user, err)
+		return
+	}
+	if utf8.RuneCountInString(profile.Bio) > models.MaxBioLength {
+		err = errors.Public(fmt.Errorf("update profile: bio too long"),
+			fmt.Sprintf("Your bio can be at most %d characters long.", models.MaxBioLength))
+		p.renderEdit(w, r, user, err)
+		return
+	}
+	err = p.UserService.UpdateProfile(user.ID, profile)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidSlug):
+			err = errors.Public(err, fmt.Sprintf(
+				"Usernames must be %d to %d lowercase letters, digits or dashes, and can't start or end with a dash.",
+				models.MinSlugLength, models.MaxSlugLength))
+		case errors.Is(err, models.ErrSlugTaken):
+			err = errors.Public(err, "That username is already taken.")
+		default:
+			fmt.Println(err)
+		}
+		p.renderEdit(w, r, user, err)
+		return
+	}
+	http.Redirect(w, r, "/users/me/profile", http.StatusFound)
+}
+
+func (p Profiles) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	user, err := p.UserService.ByID(context.User(r.Context()).ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = r.ParseMultipartForm(5 << 20) // 5mb
+	if err != nil {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	file, _, err := r.FormFile("avatar")
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	err = p.UserService.SetAvatar(user.ID, file)
+	if err != nil {
+		var fileError models.FileError
+		if errors.As(err, &fileError) {
+			err = errors.Public(err, fmt.Sprintf("Avatars must be png, gif or jpg images of at most %d megapixels.", models.MaxImagePixels/1_000_000))
+			p.renderEdit(w, r, user, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/profile", http.StatusFound)
+}
+
+func (p Profiles) DeleteAvatar(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := p.UserService.DeleteAvatar(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/profile", http.StatusFound)
+}
+
+func profilePath(slug string) string {
+	return "/u/" + slug
+}
+
+// galleryProfilePath is the path of a public gallery on its owner's profile.
+func galleryProfilePath(userSlug, gallerySlug string) string {
+	return profilePath(userSlug) + "/" + gallerySlug
+}
+
+// avatarURL is the path of the user's avatar, or empty if they have none or
+// no profile to serve it from. The avatar's key is part of the URL so that a
+// new avatar gets a new URL.
+func avatarURL(user *models.User) string {
+	if user.AvatarKey == "" || user.Slug == "" {
+		return ""
+	}
+	return profilePath(user.Slug) + "/avatar?v=" + url.QueryEscape(path.Base(user.AvatarKey))
+}
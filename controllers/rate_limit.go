@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/silasburger/lenslocked/context"
+	"github.com/silasburger/lenslocked/models"
+)
+
+// RateLimitKey returns the key of the bucket that a request takes a token
+// from.
+type RateLimitKey func(r *http.Request) string
+
+// RateLimitByIP gives every client IP address its own bucket.
+func RateLimitByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// RateLimitByUser gives every signed in user their own bucket, so that users
+// sharing an IP address don't use up each other's requests. Requests without a
+// user fall back to RateLimitByIP.
+func RateLimitByUser(r *http.Request) string {
+	user := context.User(r.Context())
+	if user == nil {
+		return RateLimitByIP(r)
+	}
+	return fmt.Sprintf("user:%d", user.ID)
+}
+
+// RateLimitByRoute shares a single bucket between every client of a route.
+// The route pattern is only complete once chi has routed the request, so use
+// it with r.With on the route itself rather than r.Use on a group.
+func RateLimitByRoute(r *http.Request) string {
+	pattern := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		pattern = rctx.RoutePattern()
+	}
+	return "route:" + r.Method + " " + pattern
+}
+
+type RateLimiter struct {
+	Store models.RateLimitStore
+	Rate  models.RateLimit
+	// Name keeps the buckets of limiters with different rates apart.
+	Name string
+	// Key defaults to RateLimitByIP.
+	Key RateLimitKey
+	// Skip lets the requests it reports true for through without taking a
+	// token, or a trip to the store.
+	Skip func(r *http.Request) bool
+}
+
+// Limit responds with 429 Too Many Requests once a client has used up its
+// requests. The RateLimit-* headers tell clients where they stand on every
+// response.
+func (rl RateLimiter) Limit(next http.Handler) http.Handler {
+	key := rl.Key
+	if key == nil {
+		key = RateLimitByIP
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.Skip != nil && rl.Skip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		result, err := rl.Store.Take(rl.Name+":"+key(r), rl.Rate)
+		if err != nil {
+			// Better to let requests through than to take the site down when
+			// the store is unavailable.
+			fmt.Println(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset.Seconds())))
+		header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rl.Rate.Burst, ceilSeconds(rl.Rate.Period.Seconds())))
+		if !result.Allowed {
+			header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter.Seconds())))
+			http.Error(w, "Too many requests. Please slow down.", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StaticRequest reports whether the request is for a static asset, an image
+// or an avatar. A single page loads many of them, so counting them toward a
+// limit meant for pages would use it up after a few page views.
+func StaticRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/assets/") {
+		return true
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "galleries" && parts[2] == "images":
+		return true
+	case len(parts) == 3 && parts[0] == "u" && parts[2] == "avatar":
+		return true
+	}
+	return false
+}
+
+func ceilSeconds(seconds float64) int {
+	return int(math.Ceil(seconds))
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ProxyMiddleware finds the address of clients that connect through a
+// reverse proxy.
+type ProxyMiddleware struct {
+	// TrustedProxies are the addresses the reverse proxies in front of the
+	// server connect from. The X-Forwarded-For header is ignored on requests
+	// from anywhere else, since clients can set it to anything.
+	TrustedProxies []netip.Prefix
+}
+
+// RealIP sets the request's RemoteAddr to the client's address when the
+// request came through a trusted proxy. Proxies append the address they were
+// connected from to X-Forwarded-For, so the client is the last address in it
+// that isn't a trusted proxy; anything before that was sent by the client.
+func (pm ProxyMiddleware) RealIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pm.trusted(r.RemoteAddr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var forwarded []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(header, ",")...)
+		}
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+			if err != nil {
+				break
+			}
+			r.RemoteAddr = addr.Unmap().String()
+			if !pm.trusted(r.RemoteAddr) {
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trusted reports whether the address, with or without a port, is one of the
+// trusted proxies.
+func (pm ProxyMiddleware) trusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range pm.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
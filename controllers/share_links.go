@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+)
+
+type shareLinkExpiry struct {
+	Days  int
+	Label string
+}
+
+// shareLinkExpiries are the lifetimes offered when creating a share link. A
+// zero lifetime never expires.
+var shareLinkExpiries = []shareLinkExpiry{
+	{7, "7 days"},
+	{1, "1 day"},
+	{30, "30 days"},
+	{0, "Never"},
+}
+
+func (g Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	var expiresAt *time.Time
+	days, err := strconv.Atoi(r.FormValue("expires"))
+	if err != nil || days < 0 {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if days > 0 {
+		t := time.Now().AddDate(0, 0, days)
+		expiresAt = &t
+	}
+	var maxViews *int
+	if v := r.FormValue("max_views"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			err = errors.Public(fmt.Errorf("create share link: invalid max views %q", v),
+				"The view limit must be a whole number of at least 1.")
+			g.renderEdit(w, r, gallery, err)
+			return
+		}
+		maxViews = &n
+	}
+	_, err = g.ShareLinkService.Create(gallery.ID, expiresAt, maxViews)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userMustHaveRole(models.RoleEditor))
+	if err != nil {
+		return
+	}
+	linkID, err := strconv.Atoi(chi.URLParam(r, "linkID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.ShareLinkService.Delete(gallery.ID, linkID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%s/edit", gallery.PublicID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) shareURL(publicID string, token string) string {
+	return g.ServerURL + galleryPath(publicID) + "?share=" + url.QueryEscape(token)
+}
@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/silasburger/lenslocked/context"
+	"github.com/silasburger/lenslocked/errors"
+	"github.com/silasburger/lenslocked/models"
+	"rsc.io/qr"
+)
+
+const (
+	CookieTwoFactor = "two_factor"
+
+	// maxTwoFactorAttempts is how many codes can be tried after entering a
+	// password before the user has to sign in again.
+	maxTwoFactorAttempts = 5
+)
+
+// startTwoFactor is called in place of creating a session for users with
+// two-factor authentication enabled. It remembers who is signing in with a
+// short lived token and asks for a code.
+func (u Users) startTwoFactor(w http.ResponseWriter, r *http.Request, user *models.User, remember bool, attempts int) error {
+	vals := url.Values{
+		"remember": {strconv.FormatBool(remember)},
+		"attempts": {strconv.Itoa(attempts)},
+	}
+	pending, err := u.TokenService.Create(user.ID, models.PurposeTwoFactor, vals.Encode())
+	if err != nil {
+		return fmt.Errorf("start two-factor: %w", err)
+	}
+	setCookie(w, CookieTwoFactor, pending.Token)
+	return nil
+}
+
+func (u Users) TwoFactorSignIn(w http.ResponseWriter, r *http.Request) {
+	_, err := readCookie(r, CookieTwoFactor)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.TwoFactorSignIn.Execute(w, r, nil)
+}
+
+func (u Users) ProcessTwoFactorSignIn(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieTwoFactor)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	// The token is consumed on every attempt and reissued after a wrong code,
+	// so two requests can never race to use the same attempt.
+	pending, err := u.TokenService.Consume(token, models.PurposeTwoFactor)
+	if err != nil {
+		deleteCookie(w, CookieTwoFactor)
+		if errors.Is(err, models.ErrTokenInvalid) || errors.Is(err, models.ErrTokenExpired) {
+			err = errors.Public(err, "Your sign in has expired. Please sign in again.")
+		}
+		u.Templates.SignIn.Execute(w, r, struct{ Email string }{}, err)
+		return
+	}
+	vals, err := url.ParseQuery(pending.Data)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	remember := vals.Get("remember") == "true"
+	attempts, _ := strconv.Atoi(vals.Get("attempts"))
+	user, err := u.UsersService.ByID(pending.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	// Wrong codes count towards the same lockout as wrong passwords, so
+	// signing in again doesn't buy more guesses.
+	ip := clientIP(r)
+	err = u.ThrottleService.Allow(models.ThrottleSignIn, ip, user.Email)
+	if err != nil {
+		deleteCookie(w, CookieTwoFactor)
+		renderThrottled(w, r, u.Templates.SignIn, struct{ Email string }{user.Email}, err)
+		return
+	}
+
+	err = u.TwoFactorService.Verify(user.ID, r.FormValue("code"))
+	if err != nil {
+		if !errors.Is(err, models.ErrTwoFactorCodeInvalid) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		u.recordFailedSignIn(ip, user.Email)
+		attempts++
+		if attempts >= maxTwoFactorAttempts {
+			deleteCookie(w, CookieTwoFactor)
+			err = errors.Public(err, "Too many incorrect codes. Please sign in again.")
+			u.Templates.SignIn.Execute(w, r, struct{ Email string }{user.Email}, err)
+			return
+		}
+		err = u.startTwoFactor(w, r, user, remember, attempts)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		err = errors.Public(models.ErrTwoFactorCodeInvalid, "That code is not valid. Please try again.")
+		u.Templates.TwoFactorSignIn.Execute(w, r, nil, err)
+		return
+	}
+
+	deleteCookie(w, CookieTwoFactor)
+	u.resetSignInThrottle(user.Email)
+	u.createSession(w, r, user, remember)
+}
+
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Enabled                bool
+		RecoveryCodesRemaining int
+	}
+	user := context.User(r.Context())
+	enabled, err := u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Enabled = enabled
+	if enabled {
+		data.RecoveryCodesRemaining, err = u.TwoFactorService.RecoveryCodesRemaining(user.ID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+	}
+	u.Templates.TwoFactor.Execute(w, r, data)
+}
+
+// SetupTwoFactor starts enrolling the user and shows the QR code to scan with
+// their authenticator app.
+func (u Users) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	enabled, err := u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Redirect(w, r, "/users/me/two-factor", http.StatusFound)
+		return
+	}
+	enrollment, err := u.TwoFactorService.Begin(user.ID, user.Email)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.renderTwoFactorSetup(w, r, enrollment)
+}
+
+func (u Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		RecoveryCodes []string
+	}
+	user := context.User(r.Context())
+	codes, err := u.TwoFactorService.Enable(user.ID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrTwoFactorNotPending) {
+			http.Redirect(w, r, "/users/me/two-factor", http.StatusFound)
+			return
+		}
+		if !errors.Is(err, models.ErrTwoFactorCodeInvalid) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		enrollment, err := u.TwoFactorService.PendingEnrollment(user.ID, user.Email)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			return
+		}
+		err = errors.Public(models.ErrTwoFactorCodeInvalid, "That code is not valid. Check the time on your device and try again.")
+		u.renderTwoFactorSetup(w, r, enrollment, err)
+		return
+	}
+	data.RecoveryCodes = codes
+	u.Templates.RecoveryCodes.Execute(w, r, data)
+}
+
+func (u Users) renderTwoFactorSetup(w http.ResponseWriter, r *http.Request, enrollment *models.TwoFactorEnrollment, errs ...error) {
+	var data struct {
+		Secret string
+		QRCode template.URL
+	}
+	code, err := qr.Encode(enrollment.URI, qr.M)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Secret = enrollment.Secret
+	data.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG()))
+	u.Templates.TwoFactorSetup.Execute(w, r, data, errs...)
+}
+
+// DisableTwoFactor turns off two-factor authentication. A current code is
+// required so that someone with brief access to a signed in browser can't
+// quietly remove it.
+func (u Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if !u.verifyTwoFactorCode(w, r, user) {
+		return
+	}
+	err := u.TwoFactorService.Disable(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/two-factor", http.StatusFound)
+}
+
+func (u Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		RecoveryCodes []string
+	}
+	user := context.User(r.Context())
+	if !u.verifyTwoFactorCode(w, r, user) {
+		return
+	}
+	codes, err := u.TwoFactorService.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.RecoveryCodes = codes
+	u.Templates.RecoveryCodes.Execute(w, r, data)
+}
+
+// verifyTwoFactorCode checks the code submitted with the request. If it is not
+// valid a response has already been written and false is returned.
+func (u Users) verifyTwoFactorCode(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	err := u.TwoFactorService.Verify(user.ID, r.FormValue("code"))
+	if err == nil {
+		return true
+	}
+	if !errors.Is(err, models.ErrTwoFactorCodeInvalid) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return false
+	}
+	var data struct {
+		Enabled                bool
+		RecoveryCodesRemaining int
+	}
+	data.Enabled = true
+	data.RecoveryCodesRemaining, err = u.TwoFactorService.RecoveryCodesRemaining(user.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = errors.Public(models.ErrTwoFactorCodeInvalid, "That code is not valid.")
+	u.Templates.TwoFactor.Execute(w, r, data, err)
+	return false
+}
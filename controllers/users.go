@@ -2,9 +2,13 @@ package controllers
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/silasburger/lenslocked/context"
 	"github.com/silasburger/lenslocked/errors"
 	"github.com/silasburger/lenslocked/models"
@@ -20,11 +24,21 @@ type Users struct {
 		ResetPassword      Template
 		PasswordlessSignin Template
 		EditEmail          Template
+		Sessions           Template
+		TwoFactor          Template
+		TwoFactorSetup     Template
+		TwoFactorSignIn    Template
+		RecoveryCodes      Template
+		APITokens          Template
+		APITokenCreated    Template
 	}
-	UsersService         *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
+	UsersService     *models.UserService
+	SessionService   *models.SessionService
+	TokenService     *models.OneTimeTokenService
+	EmailService     *models.EmailService
+	TwoFactorService *models.TwoFactorService
+	ThrottleService  *models.ThrottleService
+	APITokenService  *models.APITokenService
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
@@ -50,30 +64,98 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
+	ip := clientIP(r)
+	err := u.ThrottleService.Allow(models.ThrottleSignIn, ip, data.Email)
+	if err != nil {
+		renderThrottled(w, r, u.Templates.SignIn, data, err)
+		return
+	}
 	user, err := u.UsersService.Authenticate(data.Email, data.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrPasswordMismatch) {
+			u.recordFailedSignIn(ip, data.Email)
 			err = errors.Public(err, "Incorrect email or password.")
 		}
 		u.Templates.SignIn.Execute(w, r, data, err)
 		return
 	}
-
 	u.signInUser(w, r, user)
 }
 
+// resetSignInThrottle forgets the user's failed sign ins once they have
+// fully signed in, including their second factor.
+func (u Users) resetSignInThrottle(email string) {
+	err := u.ThrottleService.Reset(models.ThrottleSignIn, email)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// recordFailedSignIn counts the failure towards locking the account, and lets
+// the owner know if it does.
+func (u Users) recordFailedSignIn(ip, email string) {
+	lockout, err := u.ThrottleService.Record(models.ThrottleSignIn, ip, email)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if lockout == nil {
+		return
+	}
+	user, err := u.UsersService.ByEmail(lockout.Email)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		return
+	}
+	resetURL := u.EmailService.ServerURL + "/forgot-pw"
+	err = u.EmailService.AccountLocked(user.Email, lockout.Until, resetURL)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// signInUser creates a session for the user, or asks for a second factor
+// first if they have two-factor authentication enabled.
 func (u Users) signInUser(w http.ResponseWriter, r *http.Request, user *models.User) {
 	var data struct {
 		Email string
 	}
 	data.Email = user.Email
-	session, err := u.SessionService.Create(user.ID)
+	remember := r.FormValue("remember") == "true"
+	enabled, err := u.TwoFactorService.Enabled(user.ID)
 	if err != nil {
 		err = errors.Public(err, "Something went wrong.")
 		u.Templates.SignIn.Execute(w, r, data, err)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
+	if enabled {
+		err = u.startTwoFactor(w, r, user, remember, 0)
+		if err != nil {
+			err = errors.Public(err, "Something went wrong.")
+			u.Templates.SignIn.Execute(w, r, data, err)
+			return
+		}
+		http.Redirect(w, r, "/signin/two-factor", http.StatusFound)
+		return
+	}
+	u.resetSignInThrottle(user.Email)
+	u.createSession(w, r, user, remember)
+}
+
+func (u Users) createSession(w http.ResponseWriter, r *http.Request, user *models.User, remember bool) {
+	var data struct {
+		Email string
+	}
+	data.Email = user.Email
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r), remember)
+	if err != nil {
+		err = errors.Public(err, "Something went wrong.")
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+	setSessionCookie(w, session)
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
@@ -92,21 +174,115 @@ func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	err = u.sendVerificationEmail(user)
+	if err != nil {
+		// The account exists at this point, so the user can still ask for a
+		// new verification email from their account page.
+		fmt.Println(err)
+	}
+	session, err := u.SessionService.Create(user.ID, r.UserAgent(), clientIP(r), false)
 	if err != nil {
 		fmt.Println(err)
 		// TODO: Long term, we should show a warning about not being able to sign
 		// the user in.
 		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
 	}
 
-	setCookie(w, CookieSession, session.Token)
+	setSessionCookie(w, session)
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
 func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		ID            int
+		Email         string
+		EmailVerified bool
+		PendingEmail  string
+	}
 	user := context.User(r.Context())
-	u.Templates.CurrentUser.Execute(w, r, user)
+	data.ID = user.ID
+	data.Email = user.Email
+	data.EmailVerified = user.EmailVerified()
+	pending, err := u.TokenService.Pending(user.ID, models.PurposeEmailVerify)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+	}
+	if pending != nil && pending.Data != user.Email {
+		data.PendingEmail = pending.Data
+	}
+	u.Templates.CurrentUser.Execute(w, r, data)
+}
+
+func (u Users) sendVerificationEmail(user *models.User) error {
+	verification, err := u.TokenService.Create(user.ID, models.PurposeEmailVerify, user.Email)
+	if err != nil {
+		return fmt.Errorf("send verification email: %w", err)
+	}
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	verifyURL := u.EmailService.ServerURL + "/verify-email?" + vals.Encode()
+	err = u.EmailService.VerifyEmail(user.Email, verifyURL)
+	if err != nil {
+		return fmt.Errorf("send verification email: %w", err)
+	}
+	return nil
+}
+
+// ResendVerification sends a new verification email to a user who has not
+// verified their address yet.
+func (u Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string
+	}
+	user := context.User(r.Context())
+	data.Email = user.Email
+	if user.EmailVerified() {
+		http.Redirect(w, r, "/users/me", http.StatusFound)
+		return
+	}
+	err := u.sendVerificationEmail(user)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.CheckYourEmail.Execute(w, r, data)
+}
+
+// ProcessVerifyEmail handles the link sent by email to verify a new account
+// or to confirm a change of email address.
+func (u Users) ProcessVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+	verification, err := u.TokenService.Consume(data.Token, models.PurposeEmailVerify)
+	if err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) {
+			http.Error(w, "Token invalid.", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, models.ErrTokenExpired) {
+			http.Error(w, "Token expired.", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	err = u.UsersService.ConfirmEmail(verification.UserID, verification.Data)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			http.Error(w, "That email address is already associated with an account.", http.StatusConflict)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
 func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
@@ -126,12 +302,120 @@ func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/signin", http.StatusFound)
 }
 
+func (u Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	type Session struct {
+		ID         int
+		Current    bool
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+		UserAgent  string
+		IPAddress  string
+	}
+	var data struct {
+		Sessions []Session
+	}
+	user := context.User(r.Context())
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	sessions, err := u.SessionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	currentHash := u.SessionService.TokenManager.Hash(token)
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, Session{
+			ID:         session.ID,
+			Current:    session.TokenHash == currentHash,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+		})
+	}
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+func (u Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	sessionID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = u.SessionService.DeleteByID(user.ID, sessionID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// RevokeOtherSessions signs the user out everywhere except on the device
+// making the request.
+func (u Users) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = u.SessionService.DeleteOthers(user.ID, token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// clientIP returns the IP address of the client making the request. Behind a
+// reverse proxy this relies on ProxyMiddleware.RealIP having set RemoteAddr.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// renderThrottled renders the page with a message saying when to try again if
+// err is a models.ThrottledError, and with err as is otherwise.
+func renderThrottled(w http.ResponseWriter, r *http.Request, tpl Template, data any, err error) {
+	var throttled models.ThrottledError
+	if errors.As(err, &throttled) {
+		seconds := ceilSeconds(throttled.RetryAfter.Seconds())
+		msg := fmt.Sprintf("Too many attempts. Please try again in %d seconds.", seconds)
+		if seconds > 90 {
+			msg = fmt.Sprintf("Too many attempts. Please try again in %d minutes.", (seconds+59)/60)
+		}
+		err = errors.Public(err, msg)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	tpl.Execute(w, r, data, err)
+}
+
 type UserMiddleware struct {
 	SessionService *models.SessionService
 }
 
 func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The user was already set from an API token.
+		if context.User(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
 		token, err := readCookie(r, CookieSession)
 		if err != nil {
 			next.ServeHTTP(w, r)
@@ -141,11 +425,20 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
-		user, err := umw.SessionService.User(token)
+		session, user, err := umw.SessionService.Refresh(token)
 		if err != nil {
+			if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrSessionExpired) {
+				deleteCookie(w, CookieSession)
+			} else {
+				fmt.Println(err)
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
+		// The session token was rotated, so hand the new one to the client.
+		if session.Token != "" {
+			setSessionCookie(w, session)
+		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
@@ -153,8 +446,14 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 	})
 }
 
+// RequireUser only lets signed in users through. API tokens are limited to
+// the API, so requests authenticated with one are turned away too.
 func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.APIToken(r.Context()) != nil {
+			http.Error(w, "API tokens can only be used with the API.", http.StatusForbidden)
+			return
+		}
 		user := context.User(r.Context())
 		if user == nil {
 			http.Redirect(w, r, "/signin", http.StatusFound)
@@ -185,16 +484,29 @@ func (u Users) ProcessPasswordlessSignin(w http.ResponseWriter, r *http.Request)
 		Email string
 	}
 	data.Email = r.FormValue("email")
-	pwReset, err := u.PasswordResetService.Create(data.Email)
+	err := u.throttleEmail(r, data.Email)
 	if err != nil {
+		renderThrottled(w, r, u.Templates.PasswordlessSignin, data, err)
+		return
+	}
+	user, err := u.UsersService.ByEmail(data.Email)
+	if err != nil {
+		// Respond the same way whether or not there is an account so that
+		// the form can't be used to find out who has one.
 		if errors.Is(err, models.ErrNotFound) {
-			err = errors.Public(models.ErrNotFound, "There is no account with that email address.")
+			u.Templates.CheckYourEmail.Execute(w, r, data)
+			return
 		}
 		u.Templates.PasswordlessSignin.Execute(w, r, data, err)
 		return
 	}
+	signin, err := u.TokenService.Create(user.ID, models.PurposeMagicLink, "")
+	if err != nil {
+		u.Templates.PasswordlessSignin.Execute(w, r, data, err)
+		return
+	}
 	vals := url.Values{
-		"token": {pwReset.Token},
+		"token": {signin.Token},
 	}
 	signinURL := u.EmailService.ServerURL + "/email-signin?" + vals.Encode()
 	err = u.EmailService.PasswordlessSignin(data.Email, signinURL)
@@ -211,7 +523,21 @@ func (u Users) ProcessEmailSignin(w http.ResponseWriter, r *http.Request) {
 		Token string
 	}
 	data.Token = r.FormValue("token")
-	user, err := u.PasswordResetService.Consume(data.Token)
+	signin, err := u.TokenService.Consume(data.Token, models.PurposeMagicLink)
+	if err != nil {
+		if errors.Is(err, models.ErrTokenInvalid) {
+			http.Error(w, "Token invalid.", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, models.ErrTokenExpired) {
+			http.Error(w, "Token expired.", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	user, err := u.UsersService.ByID(signin.UserID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -241,16 +567,24 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	// replace password with new password
 	// create a new session for them and sign them in
 	// redirect them to the users/me page
-	user, err := u.PasswordResetService.Consume(data.Token)
+	pwReset, err := u.TokenService.Consume(data.Token, models.PurposePasswordReset)
 	if err != nil {
-		// TODO: Distinguish between types of errors
-		if errors.Is(err, models.ErrPasswordResetTokenInvalid) {
+		if errors.Is(err, models.ErrTokenInvalid) {
 			http.Error(w, "Token invalid.", http.StatusBadRequest)
+			return
 		}
-		if errors.Is(err, models.ErrPasswordResetTokenExpired) {
+		if errors.Is(err, models.ErrTokenExpired) {
 			http.Error(w, "Token expired.", http.StatusBadRequest)
+			return
 		}
 		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	user, err := u.UsersService.ByID(pwReset.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 	err = u.UsersService.UpdatePassword(user.ID, data.Password)
@@ -270,14 +604,27 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 		Email string
 	}
 	data.Email = r.FormValue("email")
-	pwReset, err := u.PasswordResetService.Create(data.Email)
+	err := u.throttleEmail(r, data.Email)
+	if err != nil {
+		renderThrottled(w, r, u.Templates.ForgotPassword, data, err)
+		return
+	}
+	user, err := u.UsersService.ByEmail(data.Email)
 	if err != nil {
+		// Respond the same way whether or not there is an account so that
+		// the form can't be used to find out who has one.
 		if errors.Is(err, models.ErrNotFound) {
-			err = errors.Public(models.ErrNotFound, "There is no account with that email address.")
+			u.Templates.CheckYourEmail.Execute(w, r, data)
+			return
 		}
 		u.Templates.ForgotPassword.Execute(w, r, data, err)
 		return
 	}
+	pwReset, err := u.TokenService.Create(user.ID, models.PurposePasswordReset, "")
+	if err != nil {
+		u.Templates.ForgotPassword.Execute(w, r, data, err)
+		return
+	}
 	vals := url.Values{
 		"token": {pwReset.Token},
 	}
@@ -303,12 +650,42 @@ func (u Users) ProcessEditEmail(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
 	data.Email = r.FormValue("email")
 
-	err := u.UsersService.UpdateEmail(user.ID, data.Email)
+	// The new address only replaces the old one once the user follows the
+	// link sent to it.
+	verification, err := u.TokenService.Create(user.ID, models.PurposeEmailVerify, data.Email)
 	if err != nil {
 		err = errors.Public(err, "Something went wrong.")
 		u.Templates.EditEmail.Execute(w, r, data, err)
 		return
 	}
+	vals := url.Values{
+		"token": {verification.Token},
+	}
+	confirmURL := u.EmailService.ServerURL + "/verify-email?" + vals.Encode()
+	err = u.EmailService.ConfirmEmailChange(data.Email, confirmURL)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+	err = u.EmailService.EmailChangeNotice(user.Email, data.Email)
+	if err != nil {
+		fmt.Println(err)
+	}
+	u.Templates.CheckYourEmail.Execute(w, r, data)
+}
 
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+// throttleEmail counts a request to email a link to the address. Every request
+// counts, whether or not the address has an account.
+func (u Users) throttleEmail(r *http.Request, email string) error {
+	ip := clientIP(r)
+	err := u.ThrottleService.Allow(models.ThrottleEmail, ip, email)
+	if err != nil {
+		return err
+	}
+	_, err = u.ThrottleService.Record(models.ThrottleEmail, ip, email)
+	if err != nil {
+		return err
+	}
+	return nil
 }
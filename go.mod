@@ -12,6 +12,8 @@ require (
 	github.com/joho/godotenv v1.5.1
 	github.com/pressly/goose/v3 v3.24.1
 	golang.org/x/crypto v0.32.0
+	golang.org/x/image v0.23.0
+	rsc.io/qr v0.2.0
 )
 
 require (
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions DROP CONSTRAINT sessions_user_id_key;
+ALTER TABLE sessions
+  ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ADD COLUMN last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+  ADD COLUMN ip_address TEXT NOT NULL DEFAULT '';
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_user_id_idx;
+ALTER TABLE sessions
+  DROP COLUMN created_at,
+  DROP COLUMN last_seen_at,
+  DROP COLUMN user_agent,
+  DROP COLUMN ip_address;
+-- Only the newest session of each user can be kept.
+DELETE FROM sessions older
+  USING sessions newer
+  WHERE older.user_id = newer.user_id AND older.id < newer.id;
+ALTER TABLE sessions ADD CONSTRAINT sessions_user_id_key UNIQUE (user_id);
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE sessions
+  ADD COLUMN expires_at TIMESTAMPTZ NOT NULL DEFAULT NOW() + INTERVAL '30 days',
+  ADD COLUMN rotated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  ADD COLUMN previous_token_hash TEXT,
+  ADD COLUMN persistent BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE sessions ALTER COLUMN expires_at DROP DEFAULT;
+CREATE INDEX sessions_previous_token_hash_idx ON sessions (previous_token_hash);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX sessions_previous_token_hash_idx;
+ALTER TABLE sessions
+  DROP COLUMN expires_at,
+  DROP COLUMN rotated_at,
+  DROP COLUMN previous_token_hash,
+  DROP COLUMN persistent;
+-- +goose StatementEnd
@@ -0,0 +1,47 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE one_time_tokens (
+  id SERIAL PRIMARY KEY,
+  user_id INT REFERENCES users (id) ON DELETE CASCADE,
+  purpose TEXT NOT NULL CHECK (purpose IN ('reset', 'magic-link', 'email-verify')),
+  data TEXT NOT NULL DEFAULT '',
+  token_hash TEXT UNIQUE NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX one_time_tokens_user_id_purpose_idx ON one_time_tokens (user_id, purpose);
+CREATE INDEX one_time_tokens_expires_at_idx ON one_time_tokens (expires_at);
+
+-- Pending email verifications keep working. Password reset rows are dropped
+-- since there is no telling whether they were issued for a reset or for a
+-- sign-in link.
+INSERT INTO one_time_tokens (user_id, purpose, data, token_hash, expires_at)
+  SELECT user_id, 'email-verify', email, token_hash, expires_at
+  FROM email_verifications;
+
+DROP TABLE email_verifications;
+DROP TABLE password_resets;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE password_resets (
+  id SERIAL PRIMARY KEY,
+  user_id INT UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+  token_hash TEXT UNIQUE NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE email_verifications (
+  id SERIAL PRIMARY KEY,
+  user_id INT UNIQUE NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  email TEXT NOT NULL,
+  token_hash TEXT UNIQUE NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL
+);
+INSERT INTO email_verifications (user_id, email, token_hash, expires_at)
+  SELECT DISTINCT ON (user_id) user_id, data, token_hash, expires_at
+  FROM one_time_tokens
+  WHERE purpose = 'email-verify' AND user_id IS NOT NULL
+  ORDER BY user_id, created_at DESC;
+DROP TABLE one_time_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN totp_secret TEXT,
+  ADD COLUMN totp_enabled_at TIMESTAMPTZ,
+  ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+  id SERIAL PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  code_hash TEXT NOT NULL,
+  used_at TIMESTAMPTZ
+);
+CREATE INDEX recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+ALTER TABLE one_time_tokens DROP CONSTRAINT one_time_tokens_purpose_check;
+ALTER TABLE one_time_tokens ADD CONSTRAINT one_time_tokens_purpose_check
+  CHECK (purpose IN ('reset', 'magic-link', 'email-verify', 'two-factor'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM one_time_tokens WHERE purpose = 'two-factor';
+ALTER TABLE one_time_tokens DROP CONSTRAINT one_time_tokens_purpose_check;
+ALTER TABLE one_time_tokens ADD CONSTRAINT one_time_tokens_purpose_check
+  CHECK (purpose IN ('reset', 'magic-link', 'email-verify'));
+
+DROP TABLE recovery_codes;
+ALTER TABLE users
+  DROP COLUMN totp_secret,
+  DROP COLUMN totp_enabled_at,
+  DROP COLUMN totp_last_step;
+-- +goose StatementEnd
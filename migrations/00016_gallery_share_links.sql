@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE gallery_share_links (
+  id SERIAL PRIMARY KEY,
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ,
+  max_views INT,
+  views INT NOT NULL DEFAULT 0
+);
+CREATE INDEX gallery_share_links_gallery_id_idx ON gallery_share_links (gallery_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_share_links;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+  ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private'
+  CHECK (visibility IN ('private', 'unlisted', 'public'));
+UPDATE galleries SET visibility = 'public' WHERE published;
+ALTER TABLE galleries DROP COLUMN published;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN published BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE galleries SET published = visibility <> 'private';
+ALTER TABLE galleries DROP COLUMN visibility;
+-- +goose StatementEnd
@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE gallery_members (
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  role TEXT NOT NULL CHECK (role IN ('viewer', 'contributor', 'editor')),
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (gallery_id, user_id)
+);
+CREATE INDEX gallery_members_user_id_idx ON gallery_members (user_id);
+
+CREATE TABLE gallery_invitations (
+  id SERIAL PRIMARY KEY,
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  email TEXT NOT NULL,
+  role TEXT NOT NULL CHECK (role IN ('viewer', 'contributor', 'editor')),
+  invited_by INT REFERENCES users (id) ON DELETE SET NULL,
+  token_hash TEXT UNIQUE NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  expires_at TIMESTAMPTZ NOT NULL,
+  UNIQUE (gallery_id, email)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_invitations;
+DROP TABLE gallery_members;
+-- +goose StatementEnd
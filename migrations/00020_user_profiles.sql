@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+  ADD COLUMN slug TEXT UNIQUE,
+  ADD COLUMN display_name TEXT NOT NULL DEFAULT '',
+  ADD COLUMN bio TEXT NOT NULL DEFAULT '',
+  ADD COLUMN avatar_key TEXT;
+
+-- Slugs that users changed away from, so that links to their old profile
+-- keep working. An old slug stays reserved for the user who had it.
+CREATE TABLE user_slug_redirects (
+  slug TEXT PRIMARY KEY,
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX user_slug_redirects_user_id_idx ON user_slug_redirects (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_slug_redirects;
+ALTER TABLE users
+  DROP COLUMN slug,
+  DROP COLUMN display_name,
+  DROP COLUMN bio,
+  DROP COLUMN avatar_key;
+-- +goose StatementEnd
@@ -0,0 +1,49 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries
+  ADD COLUMN public_id TEXT,
+  ADD COLUMN slug TEXT;
+
+-- Existing galleries get the same kind of public ID and slug that new ones
+-- are created with: 12 URL safe random characters, and the title lowercased
+-- with everything but letters and digits turned into dashes.
+UPDATE galleries
+SET public_id = translate(left(encode(decode(replace(gen_random_uuid()::text, '-', ''), 'hex'), 'base64'), 12), '+/', '-_'),
+  slug = COALESCE(NULLIF(trim(BOTH '-' FROM left(regexp_replace(lower(title), '[^a-z0-9]+', '-', 'g'), 60)), ''), 'gallery');
+
+-- "avatar" is taken by the owner's avatar, and an owner's galleries with the
+-- same title get their ID appended.
+UPDATE galleries SET slug = 'avatar-2' WHERE slug = 'avatar';
+UPDATE galleries
+SET slug = galleries.slug || '-' || galleries.id
+FROM (
+  SELECT id, row_number() OVER (PARTITION BY user_id, slug ORDER BY id) AS n
+  FROM galleries
+) AS duplicates
+WHERE duplicates.id = galleries.id AND duplicates.n > 1;
+
+ALTER TABLE galleries
+  ALTER COLUMN public_id SET NOT NULL,
+  ALTER COLUMN slug SET NOT NULL,
+  ADD CONSTRAINT galleries_public_id_key UNIQUE (public_id),
+  ADD CONSTRAINT galleries_user_id_slug_key UNIQUE (user_id, slug);
+
+-- Slugs that galleries changed away from, so that links to them keep working.
+-- An old slug stays reserved for the gallery that had it.
+CREATE TABLE gallery_slug_redirects (
+  user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  slug TEXT NOT NULL,
+  gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, slug)
+);
+CREATE INDEX gallery_slug_redirects_gallery_id_idx ON gallery_slug_redirects (gallery_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_slug_redirects;
+ALTER TABLE galleries
+  DROP COLUMN public_id,
+  DROP COLUMN slug;
+-- +goose StatementEnd
@@ -0,0 +1,32 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+  ADD COLUMN position INT NOT NULL DEFAULT 0,
+  ADD COLUMN title TEXT NOT NULL DEFAULT '',
+  ADD COLUMN caption TEXT NOT NULL DEFAULT '',
+  ADD COLUMN alt_text TEXT NOT NULL DEFAULT '';
+
+-- Existing images keep the order they were shown in, oldest first.
+UPDATE images
+SET position = ordered.position
+FROM (
+  SELECT id, row_number() OVER (PARTITION BY gallery_id ORDER BY created_at, id) AS position
+  FROM images
+) AS ordered
+WHERE ordered.id = images.id;
+
+-- Galleries without a cover image use their first image.
+ALTER TABLE galleries
+  ADD COLUMN cover_image_id INT REFERENCES images (id) ON DELETE SET NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN cover_image_id;
+ALTER TABLE images
+  DROP COLUMN position,
+  DROP COLUMN title,
+  DROP COLUMN caption,
+  DROP COLUMN alt_text;
+-- +goose StatementEnd
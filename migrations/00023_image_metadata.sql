@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE image_metadata (
+  image_id INT PRIMARY KEY REFERENCES images (id) ON DELETE CASCADE,
+  camera_make TEXT NOT NULL DEFAULT '',
+  camera_model TEXT NOT NULL DEFAULT '',
+  lens_model TEXT NOT NULL DEFAULT '',
+  exposure_time DOUBLE PRECISION NOT NULL DEFAULT 0,
+  f_number DOUBLE PRECISION NOT NULL DEFAULT 0,
+  focal_length DOUBLE PRECISION NOT NULL DEFAULT 0,
+  iso INT NOT NULL DEFAULT 0,
+  -- The camera's clock when the photo was taken. Cameras that don't record
+  -- their UTC offset don't say which time zone it is in.
+  captured_at TIMESTAMP,
+  latitude DOUBLE PRECISION,
+  longitude DOUBLE PRECISION
+);
+
+-- Where photos were taken is only shown to the gallery's editors unless they
+-- choose otherwise.
+ALTER TABLE galleries
+  ADD COLUMN show_location BOOLEAN NOT NULL DEFAULT FALSE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN show_location;
+DROP TABLE image_metadata;
+-- +goose StatementEnd
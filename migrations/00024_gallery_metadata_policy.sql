@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Originals were served with all their metadata until now. Where they were
+-- taken is removed from now on unless owners choose to keep it.
+ALTER TABLE galleries
+  ADD COLUMN metadata_policy TEXT NOT NULL DEFAULT 'strip_location'
+  CHECK (metadata_policy IN ('keep', 'strip_location', 'strip_all'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+  DROP COLUMN metadata_policy;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Links that have used up their views keep loading images for a while after
+-- the last view, so the page that used it up still works.
+ALTER TABLE gallery_share_links
+  ADD COLUMN last_viewed_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE gallery_share_links
+  DROP COLUMN last_viewed_at;
+-- +goose StatementEnd
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAPITokenExpired = errors.New("models: api token has expired")
+)
+
+// APIScope limits what an API token can be used for.
+type APIScope string
+
+const (
+	ScopeReadGalleries  APIScope = "galleries:read"
+	ScopeWriteGalleries APIScope = "galleries:write"
+	ScopeUploadImages   APIScope = "images:upload"
+)
+
+// APIScopes lists every scope, in the order they are offered to users.
+var APIScopes = []APIScope{ScopeReadGalleries, ScopeWriteGalleries, ScopeUploadImages}
+
+const (
+	// APITokenPrefix starts every API token so that leaked tokens are easy
+	// to recognize, for example by secret scanners.
+	APITokenPrefix = "lenslocked_"
+
+	// apiTokenTouchInterval limits how often LastUsedAt is written so that
+	// every request does not cause a database write.
+	apiTokenTouchInterval = 1 * time.Minute
+)
+
+// APIToken is a long lived credential that a user creates to access the API
+// from scripts and other apps.
+type APIToken struct {
+	ID     int
+	UserID int
+	Name   string
+	// Token is only set when creating a new token. Only the hash is stored,
+	// so the token can't be shown again afterwards.
+	Token      string
+	TokenHash  string
+	Scopes     []APIScope
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	// ExpiresAt is nil for tokens that never expire.
+	ExpiresAt *time.Time
+}
+
+// HasScope reports whether the token was granted the scope.
+func (t APIToken) HasScope(scope APIScope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type APITokenService struct {
+	DB           *sql.DB
+	TokenManager *TokenManager
+}
+
+// Create makes a new API token for the user. The token is returned in the
+// Token field, but only its hash is stored. A nil expiresAt creates a token
+// that never expires.
+func (ats *APITokenService) Create(userID int, name string, scopes []APIScope, expiresAt *time.Time) (*APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("create api token: name is required")
+	}
+	for _, scope := range scopes {
+		if !validAPIScope(scope) {
+			return nil, fmt.Errorf("create api token: invalid scope %q", scope)
+		}
+	}
+	token, _, err := ats.TokenManager.New()
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	token = APITokenPrefix + token
+	apiToken := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Token:     token,
+		TokenHash: ats.TokenManager.Hash(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+	row := ats.DB.QueryRow(`
+		INSERT INTO api_tokens (user_id, name, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;`,
+		userID, name, apiToken.TokenHash, joinAPIScopes(scopes), expiresAt)
+	err = row.Scan(&apiToken.ID, &apiToken.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create api token: %w", err)
+	}
+	return &apiToken, nil
+}
+
+// Authenticate looks up the API token and returns it along with its user.
+// ErrNotFound is returned for unknown tokens and ErrAPITokenExpired for
+// expired ones. Authenticate also records that the token was just used.
+func (ats *APITokenService) Authenticate(token string) (*APIToken, *User, error) {
+	var apiToken APIToken
+	var user User
+	var scopes string
+	row := ats.DB.QueryRow(`
+		SELECT api_tokens.id,
+			api_tokens.name,
+			api_tokens.token_hash,
+			api_tokens.scopes,
+			api_tokens.created_at,
+			api_tokens.last_used_at,
+			api_tokens.expires_at,
+			users.id,
+			users.email,
+			users.password_hash,
+			users.email_verified_at
+		FROM api_tokens
+			JOIN users ON users.id = api_tokens.user_id
+		WHERE api_tokens.token_hash = $1;`, ats.TokenManager.Hash(token))
+	err := row.Scan(&apiToken.ID, &apiToken.Name, &apiToken.TokenHash, &scopes,
+		&apiToken.CreatedAt, &apiToken.LastUsedAt, &apiToken.ExpiresAt,
+		&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("authenticate api token: %w", err)
+	}
+	apiToken.UserID = user.ID
+	apiToken.Scopes = splitAPIScopes(scopes)
+
+	now := time.Now()
+	if apiToken.ExpiresAt != nil && now.After(*apiToken.ExpiresAt) {
+		return nil, nil, ErrAPITokenExpired
+	}
+	if apiToken.LastUsedAt == nil || now.Sub(*apiToken.LastUsedAt) > apiTokenTouchInterval {
+		_, err = ats.DB.Exec(`
+			UPDATE api_tokens
+			SET last_used_at = $2
+			WHERE id = $1;`, apiToken.ID, now)
+		if err != nil {
+			return nil, nil, fmt.Errorf("authenticate api token: %w", err)
+		}
+		apiToken.LastUsedAt = &now
+	}
+	return &apiToken, &user, nil
+}
+
+// ByUserID returns all of the user's API tokens, newest first, including
+// expired ones.
+func (ats *APITokenService) ByUserID(userID int) ([]APIToken, error) {
+	rows, err := ats.DB.Query(`
+		SELECT id, name, token_hash, scopes, created_at, last_used_at, expires_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+	defer rows.Close()
+	var apiTokens []APIToken
+	for rows.Next() {
+		apiToken := APIToken{
+			UserID: userID,
+		}
+		var scopes string
+		err := rows.Scan(&apiToken.ID, &apiToken.Name, &apiToken.TokenHash, &scopes,
+			&apiToken.CreatedAt, &apiToken.LastUsedAt, &apiToken.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("query api tokens by user: %w", err)
+		}
+		apiToken.Scopes = splitAPIScopes(scopes)
+		apiTokens = append(apiTokens, apiToken)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query api tokens by user: %w", err)
+	}
+	return apiTokens, nil
+}
+
+// Delete revokes one of the user's API tokens. ErrNotFound is returned if the
+// token does not exist or belongs to another user.
+func (ats *APITokenService) Delete(userID, id int) error {
+	row := ats.DB.QueryRow(`
+		DELETE FROM api_tokens
+		WHERE id = $1 AND user_id = $2
+		RETURNING id;`, id, userID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete api token: %w", err)
+	}
+	return nil
+}
+
+func validAPIScope(scope APIScope) bool {
+	for _, s := range APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func joinAPIScopes(scopes []APIScope) string {
+	strs := make([]string, len(scopes))
+	for i, scope := range scopes {
+		strs[i] = string(scope)
+	}
+	return strings.Join(strs, " ")
+}
+
+func splitAPIScopes(scopes string) []APIScope {
+	var result []APIScope
+	for _, s := range strings.Fields(scopes) {
+		result = append(result, APIScope(s))
+	}
+	return result
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DevEmailer never sends emails. Instead it writes them to Dir as .eml files,
+// which most mail clients can open, or prints them to Out if Dir is empty.
+// It is meant for development.
+type DevEmailer struct {
+	Dir string
+	// Out defaults to os.Stdout.
+	Out io.Writer
+
+	mu sync.Mutex
+	n  int
+}
+
+func (de *DevEmailer) DialAndSend(email *Email) error {
+	_, err := de.Deliver(email)
+	if err != nil {
+		return fmt.Errorf("dialandsend: %w", err)
+	}
+	return nil
+}
+
+// Deliver writes the email and returns where it was written to.
+func (de *DevEmailer) Deliver(email *Email) (string, error) {
+	msg := newMailMessage(email)
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if de.Dir == "" {
+		out := de.Out
+		if out == nil {
+			out = os.Stdout
+		}
+		_, err := msg.WriteTo(out)
+		if err != nil {
+			return "", fmt.Errorf("deliver: %w", err)
+		}
+		fmt.Fprintln(out)
+		return "written to stdout", nil
+	}
+
+	err := os.MkdirAll(de.Dir, 0755)
+	if err != nil {
+		return "", fmt.Errorf("deliver: %w", err)
+	}
+	de.n++
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405"), de.n)
+	path := filepath.Join(de.Dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("deliver: %w", err)
+	}
+	defer f.Close()
+	_, err = msg.WriteTo(f)
+	if err != nil {
+		return "", fmt.Errorf("deliver: %w", err)
+	}
+	return "written to " + path, nil
+}
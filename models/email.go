@@ -1,16 +1,86 @@
 package models
 
 import (
+	"database/sql"
 	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
 )
 
 const (
 	DefaultSender = "support@lenslocked.silasburger.com"
 )
 
+const (
+	// JobSendEmail is the kind of job enqueued by EmailService.Send.
+	JobSendEmail = "send_email"
+)
+
+const (
+	EmailBackendMailTrap = "mailtrap"
+	EmailBackendSMTP     = "smtp"
+	EmailBackendDev      = "dev"
+)
+
 type MailConfig struct {
+	// Backend is one of EmailBackendMailTrap (the default), EmailBackendSMTP
+	// or EmailBackendDev.
+	Backend string
+
+	// SendEndpoint and Token are used by the MailTrap backend.
 	SendEndpoint string
 	Token        string
+
+	SMTP SMTPConfig
+
+	// DevDir is where the dev backend writes emails. They are printed to
+	// stdout if it is empty.
+	DevDir string
+}
+
+// DefaultMailConfig reads the MailConfig from the environment.
+func DefaultMailConfig() (MailConfig, error) {
+	var cfg MailConfig
+	err := godotenv.Load()
+	if err != nil {
+		return cfg, err
+	}
+	cfg = MailConfig{
+		Backend:      os.Getenv("EMAIL_BACKEND"),
+		SendEndpoint: os.Getenv("MAIL_SEND_ENDPOINT"),
+		Token:        os.Getenv("MAIL_TOKEN"),
+		SMTP: SMTPConfig{
+			Host:     os.Getenv("SMTP_HOST"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			TLS:      os.Getenv("SMTP_TLS"),
+		},
+		DevDir: os.Getenv("EMAIL_DEV_DIR"),
+	}
+	if portStr := os.Getenv("SMTP_PORT"); portStr != "" {
+		cfg.SMTP.Port, err = strconv.Atoi(portStr)
+		if err != nil {
+			return cfg, fmt.Errorf("SMTP_PORT: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// NewEmailer returns the Emailer for the configured backend.
+func NewEmailer(cfg MailConfig) (Emailer, error) {
+	switch cfg.Backend {
+	case "", EmailBackendMailTrap:
+		return &MailTrap{SendEndpoint: cfg.SendEndpoint, Token: cfg.Token}, nil
+	case EmailBackendSMTP:
+		return NewSMTPEmailer(cfg.SMTP)
+	case EmailBackendDev:
+		return &DevEmailer{Dir: cfg.DevDir}, nil
+	default:
+		return nil, fmt.Errorf("new emailer: unknown backend %q", cfg.Backend)
+	}
 }
 
 type Email struct {
@@ -27,6 +97,28 @@ type EmailService struct {
 	SendEndpoint  string
 	Token         string
 	Emailer
+
+	// DB is where the outbox of emails is kept. If not set, emails are sent
+	// without being stored, and failed emails are lost.
+	DB *sql.DB
+
+	// Jobs is used to send emails in the background. If not set, emails are
+	// sent immediately.
+	Jobs *JobService
+
+	// MaxAttempts is the number of times delivering an email from the outbox
+	// is tried before it is marked as failed. It should match the
+	// MaxAttempts of Jobs. Defaults to DefaultJobMaxAttempts.
+	MaxAttempts int
+
+	// Retention is how long emails are kept in the outbox before Sweep
+	// deletes them. Defaults to DefaultEmailRetention.
+	Retention time.Duration
+
+	// KeepBodies keeps the bodies of emails in the outbox after they have been
+	// sent. They contain sign in links and other tokens, so this should only
+	// be set in development, where the dev inbox shows them.
+	KeepBodies bool
 }
 
 type Emailer interface {
@@ -40,55 +132,138 @@ func NewEmailService(emailer Emailer, serverURL string) *EmailService {
 	}
 	return &es
 }
+
+type forgotPasswordData struct {
+	ResetURL string
+}
+
 func (es EmailService) ForgotPassword(to, resetURL string) error {
-	htmlBody := fmt.Sprintf(`
-	<html>
-	<body>
-		<p>o reset your password please visit the following URL:</p>
-		<a href="%s">Reset Password</a>
-	</body>
-	</html>
-	`, resetURL)
-	plaintextBody := fmt.Sprintf("To reset your password please visit the following URL: %s", resetURL)
-	email := &Email{
-		To:      to,
-		Subject: "Reset your password",
-		Text:    plaintextBody,
-		HTML:    htmlBody,
-	}
-	email.From = es.setFrom(email)
-	err := es.Send(email)
+	err := es.sendTemplate(to, "forgot-password", forgotPasswordData{
+		ResetURL: resetURL,
+	})
 	if err != nil {
 		return fmt.Errorf("ForgotPassword: %w", err)
 	}
 	return nil
 }
 
+type passwordlessSigninData struct {
+	SigninURL string
+}
+
 func (es EmailService) PasswordlessSignin(to, signinURL string) error {
-	htmlBody := fmt.Sprintf(`
-		<html>
-		<body>
-			<p>Click below to sign in to your account:</p>
-			<a href="%s">Sign in</a>
-		</body>
-		</html>
-		`, signinURL)
-	plaintextBody := fmt.Sprintf("To sign in to your account visit following URL: %s", signinURL)
-	email := &Email{
-		To:      to,
-		Subject: "Sign in link",
-		Text:    plaintextBody,
-		HTML:    htmlBody,
-	}
-	email.From = es.setFrom(email)
-	err := es.Send(email)
+	err := es.sendTemplate(to, "passwordless-signin", passwordlessSigninData{
+		SigninURL: signinURL,
+	})
 	if err != nil {
 		return fmt.Errorf("PasswordlessSignin: %w", err)
 	}
 	return nil
 }
 
+type verifyEmailData struct {
+	VerifyURL string
+}
+
+func (es EmailService) VerifyEmail(to, verifyURL string) error {
+	err := es.sendTemplate(to, "verify-email", verifyEmailData{
+		VerifyURL: verifyURL,
+	})
+	if err != nil {
+		return fmt.Errorf("VerifyEmail: %w", err)
+	}
+	return nil
+}
+
+type confirmEmailChangeData struct {
+	ConfirmURL string
+}
+
+// ConfirmEmailChange is sent to the new address when a user changes their
+// email. The change only takes effect once the link is visited.
+func (es EmailService) ConfirmEmailChange(to, confirmURL string) error {
+	err := es.sendTemplate(to, "confirm-email-change", confirmEmailChangeData{
+		ConfirmURL: confirmURL,
+	})
+	if err != nil {
+		return fmt.Errorf("ConfirmEmailChange: %w", err)
+	}
+	return nil
+}
+
+type emailChangeNoticeData struct {
+	NewEmail string
+}
+
+// EmailChangeNotice is sent to the old address when a user asks to change
+// their email, so the owner finds out if someone else is doing it.
+func (es EmailService) EmailChangeNotice(to, newEmail string) error {
+	err := es.sendTemplate(to, "email-change-notice", emailChangeNoticeData{
+		NewEmail: newEmail,
+	})
+	if err != nil {
+		return fmt.Errorf("EmailChangeNotice: %w", err)
+	}
+	return nil
+}
+
+type accountLockedData struct {
+	Until    string
+	ResetURL string
+}
+
+// AccountLocked is sent when sign in to an account is locked after too many
+// failed attempts, so the owner finds out if someone is guessing their
+// password.
+func (es EmailService) AccountLocked(to string, until time.Time, resetURL string) error {
+	err := es.sendTemplate(to, "account-locked", accountLockedData{
+		Until:    until.UTC().Format("Jan 2, 2006 15:04 MST"),
+		ResetURL: resetURL,
+	})
+	if err != nil {
+		return fmt.Errorf("AccountLocked: %w", err)
+	}
+	return nil
+}
+
+type galleryInvitationData struct {
+	InvitedBy    string
+	GalleryTitle string
+	Role         GalleryRole
+	AcceptURL    string
+}
+
+// GalleryInvitation is sent to someone who was invited to join a gallery.
+func (es EmailService) GalleryInvitation(to, invitedBy, galleryTitle string, role GalleryRole, acceptURL string) error {
+	err := es.sendTemplate(to, "gallery-invitation", galleryInvitationData{
+		InvitedBy:    invitedBy,
+		GalleryTitle: galleryTitle,
+		Role:         role,
+		AcceptURL:    acceptURL,
+	})
+	if err != nil {
+		return fmt.Errorf("GalleryInvitation: %w", err)
+	}
+	return nil
+}
+
+// Send stores the email in the outbox, if the EmailService has a DB, and
+// sends it. It is sent by a worker if the EmailService has a JobService.
 func (es EmailService) Send(email *Email) error {
+	if es.DB != nil {
+		err := es.queue(email)
+		if err != nil {
+			return fmt.Errorf("send: %w", err)
+		}
+		return nil
+	}
+	if es.Jobs != nil {
+		_, err := es.Jobs.Enqueue(JobSendEmail, email)
+		if err != nil {
+			return fmt.Errorf("send: %w", err)
+		}
+		return nil
+	}
 	err := es.Emailer.DialAndSend(email)
 	if err != nil {
 		return fmt.Errorf("send: %w", err)
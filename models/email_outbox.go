@@ -0,0 +1,257 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	// EmailFailed is the status of an email that could not be delivered
+	// after MaxAttempts tries.
+	EmailFailed = "failed"
+)
+
+// DefaultEmailRetention is how long emails are kept in the outbox by default.
+const DefaultEmailRetention = 30 * 24 * time.Hour
+
+// OutboxEmail is an email stored in the outbox, along with a record of
+// delivering it.
+type OutboxEmail struct {
+	Email
+	ID       int
+	Status   string
+	Attempts int
+	// LastError is why the most recent delivery attempt failed.
+	LastError string
+	// ProviderResponse is what the Emailer reported about the delivered
+	// email, such as the message ID it was given.
+	ProviderResponse string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	SentAt           *time.Time
+}
+
+// DeliveryReporter is implemented by Emailers that can report the provider's
+// response to a delivered email. The response is kept in the outbox.
+type DeliveryReporter interface {
+	Deliver(email *Email) (response string, err error)
+}
+
+type sendEmailJob struct {
+	EmailID int
+}
+
+// queue stores the email in the outbox and then delivers it, or enqueues it to
+// be delivered by a worker if the EmailService has a JobService.
+func (es EmailService) queue(email *Email) error {
+	var id int
+	row := es.DB.QueryRow(`
+		INSERT INTO emails (to_address, from_address, subject, text_body, html_body)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id;`, email.To, email.From, email.Subject, email.Text, email.HTML)
+	err := row.Scan(&id)
+	if err != nil {
+		return fmt.Errorf("queue email: %w", err)
+	}
+	if es.Jobs != nil {
+		_, err = es.Jobs.Enqueue(JobSendEmail, sendEmailJob{EmailID: id})
+		if err != nil {
+			return fmt.Errorf("queue email: %w", err)
+		}
+		return nil
+	}
+	return es.deliver(id)
+}
+
+// deliver sends the email in the outbox with the given ID and records the
+// outcome. Emails that have already been sent, or have failed for good, are
+// skipped. Once an email is no longer pending its bodies are cleared, since
+// they hold links with tokens in them, unless KeepBodies is set.
+func (es EmailService) deliver(id int) error {
+	email, err := es.OutboxEmail(id)
+	if err != nil {
+		return fmt.Errorf("deliver email %d: %w", id, err)
+	}
+	if email.Status != EmailPending {
+		return nil
+	}
+	email.Attempts++
+	var response string
+	if reporter, ok := es.Emailer.(DeliveryReporter); ok {
+		response, err = reporter.Deliver(&email.Email)
+	} else {
+		err = es.Emailer.DialAndSend(&email.Email)
+	}
+	if err != nil {
+		status := EmailPending
+		// An email that may have been delivered isn't tried again, so that
+		// it isn't delivered twice.
+		if email.Attempts >= es.maxAttempts() || errors.Is(err, ErrEmailMaybeSent) {
+			status = EmailFailed
+		}
+		clearBodies := status == EmailFailed && !es.KeepBodies
+		_, dbErr := es.DB.Exec(`
+			UPDATE emails
+			SET status = $2, attempts = $3, last_error = $4, updated_at = NOW(),
+				text_body = CASE WHEN $5 THEN '' ELSE text_body END,
+				html_body = CASE WHEN $5 THEN '' ELSE html_body END
+			WHERE id = $1;`, id, status, email.Attempts, err.Error(), clearBodies)
+		if dbErr != nil {
+			return fmt.Errorf("deliver email %d: %w", id, dbErr)
+		}
+		return fmt.Errorf("deliver email %d: %w", id, err)
+	}
+	_, err = es.DB.Exec(`
+		UPDATE emails
+		SET status = $2, attempts = $3, last_error = '', provider_response = $4,
+			sent_at = NOW(), updated_at = NOW(),
+			text_body = CASE WHEN $5 THEN '' ELSE text_body END,
+			html_body = CASE WHEN $5 THEN '' ELSE html_body END
+		WHERE id = $1;`, id, EmailSent, email.Attempts, response, !es.KeepBodies)
+	if err != nil {
+		return fmt.Errorf("deliver email %d: %w", id, err)
+	}
+	return nil
+}
+
+// DeleteOld deletes the emails in the outbox that were created longer ago
+// than the retention period, and returns how many were deleted.
+func (es EmailService) DeleteOld() (int64, error) {
+	result, err := es.DB.Exec(`
+		DELETE FROM emails
+		WHERE created_at < $1;`, time.Now().Add(-es.retention()))
+	if err != nil {
+		return 0, fmt.Errorf("delete old emails: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete old emails: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep calls DeleteOld every interval until the context is cancelled.
+func (es EmailService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := es.DeleteOld()
+		if err != nil {
+			log.Printf("sweeping emails: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d old emails", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (es EmailService) retention() time.Duration {
+	if es.Retention > 0 {
+		return es.Retention
+	}
+	return DefaultEmailRetention
+}
+
+func (es EmailService) maxAttempts() int {
+	if es.MaxAttempts > 0 {
+		return es.MaxAttempts
+	}
+	return DefaultJobMaxAttempts
+}
+
+// SendEmailJob is the JobHandler for JobSendEmail jobs. Returning the delivery
+// error lets the job queue retry the email with backoff.
+func (es EmailService) SendEmailJob(payload json.RawMessage) error {
+	var job sendEmailJob
+	err := json.Unmarshal(payload, &job)
+	if err != nil {
+		return fmt.Errorf("send email job: %w", err)
+	}
+	if job.EmailID == 0 {
+		// Emails sent without an outbox, including any enqueued before there
+		// was one, carry the whole email in the job.
+		var email Email
+		err = json.Unmarshal(payload, &email)
+		if err != nil {
+			return fmt.Errorf("send email job: %w", err)
+		}
+		err = es.Emailer.DialAndSend(&email)
+		if errors.Is(err, ErrEmailMaybeSent) {
+			// Retrying the job could deliver the email twice.
+			log.Printf("send email job: %v", err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("send email job: %w", err)
+		}
+		return nil
+	}
+	err = es.deliver(job.EmailID)
+	if err != nil {
+		return fmt.Errorf("send email job: %w", err)
+	}
+	return nil
+}
+
+// OutboxEmail returns the email in the outbox with the given ID.
+func (es EmailService) OutboxEmail(id int) (*OutboxEmail, error) {
+	email := OutboxEmail{
+		ID: id,
+	}
+	row := es.DB.QueryRow(`
+		SELECT to_address, from_address, subject, text_body, html_body, status,
+			attempts, last_error, provider_response, created_at, updated_at, sent_at
+		FROM emails
+		WHERE id = $1;`, id)
+	err := row.Scan(&email.To, &email.From, &email.Subject, &email.Text, &email.HTML,
+		&email.Status, &email.Attempts, &email.LastError, &email.ProviderResponse,
+		&email.CreatedAt, &email.UpdatedAt, &email.SentAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("outbox email: %w", err)
+	}
+	return &email, nil
+}
+
+// RecentEmails returns the most recently created emails in the outbox, newest
+// first. The bodies are not loaded.
+func (es EmailService) RecentEmails(limit int) ([]OutboxEmail, error) {
+	rows, err := es.DB.Query(`
+		SELECT id, to_address, from_address, subject, status, attempts,
+			last_error, created_at, updated_at, sent_at
+		FROM emails
+		ORDER BY created_at DESC, id DESC
+		LIMIT $1;`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("recent emails: %w", err)
+	}
+	defer rows.Close()
+	var emails []OutboxEmail
+	for rows.Next() {
+		var email OutboxEmail
+		err := rows.Scan(&email.ID, &email.To, &email.From, &email.Subject,
+			&email.Status, &email.Attempts, &email.LastError,
+			&email.CreatedAt, &email.UpdatedAt, &email.SentAt)
+		if err != nil {
+			return nil, fmt.Errorf("recent emails: %w", err)
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("recent emails: %w", err)
+	}
+	return emails, nil
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/silasburger/lenslocked/templates"
+)
+
+// emailTemplate is one kind of email. Its HTML and plain text bodies are
+// rendered from emails/<name>.gohtml and emails/<name>.gotxt, and the subject
+// from the "subject" template in the .gotxt file.
+type emailTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// emailSamples lists every email that is sent, in the order they are shown in
+// previews, along with sample data for previewing them.
+var emailSamples = []struct {
+	name   string
+	sample func(serverURL string) any
+}{
+	{"verify-email", func(serverURL string) any {
+		return verifyEmailData{VerifyURL: serverURL + "/verify-email?token=sample"}
+	}},
+	{"forgot-password", func(serverURL string) any {
+		return forgotPasswordData{ResetURL: serverURL + "/reset-pw?token=sample"}
+	}},
+	{"passwordless-signin", func(serverURL string) any {
+		return passwordlessSigninData{SigninURL: serverURL + "/email-signin?token=sample"}
+	}},
+	{"confirm-email-change", func(serverURL string) any {
+		return confirmEmailChangeData{ConfirmURL: serverURL + "/verify-email?token=sample"}
+	}},
+	{"email-change-notice", func(serverURL string) any {
+		return emailChangeNoticeData{NewEmail: "new.address@example.com"}
+	}},
+	{"account-locked", func(serverURL string) any {
+		return accountLockedData{
+			Until:    "Jan 2, 2006 15:04 UTC",
+			ResetURL: serverURL + "/forgot-pw",
+		}
+	}},
+	{"gallery-invitation", func(serverURL string) any {
+		return galleryInvitationData{
+			InvitedBy:    "jon@example.com",
+			GalleryTitle: "Smith wedding",
+			Role:         RoleContributor,
+			AcceptURL:    serverURL + "/invitations?token=sample",
+		}
+	}},
+}
+
+var emailTemplates = mustParseEmailTemplates(templates.FS)
+
+func mustParseEmailTemplates(fsys fs.FS) map[string]emailTemplate {
+	tpls, err := parseEmailTemplates(fsys)
+	if err != nil {
+		panic(err)
+	}
+	return tpls
+}
+
+func parseEmailTemplates(fsys fs.FS) (map[string]emailTemplate, error) {
+	funcs := map[string]any{
+		"button": func(label, url string) any {
+			return struct{ Label, URL string }{label, url}
+		},
+	}
+	tpls := make(map[string]emailTemplate)
+	for _, email := range emailSamples {
+		htmlTpl, err := htmltemplate.New(email.name).Funcs(funcs).ParseFS(fsys,
+			"emails/layout.gohtml", "emails/"+email.name+".gohtml")
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s email: %w", email.name, err)
+		}
+		textTpl, err := texttemplate.New(email.name).ParseFS(fsys,
+			"emails/layout.gotxt", "emails/"+email.name+".gotxt")
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s email: %w", email.name, err)
+		}
+		tpls[email.name] = emailTemplate{
+			html: htmlTpl,
+			text: textTpl,
+		}
+	}
+	return tpls, nil
+}
+
+// render builds the email called name from its templates. To and From are
+// left for the caller to fill in.
+func (es EmailService) render(name string, data any) (*Email, error) {
+	tpl, ok := emailTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("render %s email: %w", name, ErrNotFound)
+	}
+	var subject, text, html bytes.Buffer
+	err := tpl.text.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return nil, fmt.Errorf("render %s email: %w", name, err)
+	}
+	err = tpl.text.ExecuteTemplate(&text, "layout", data)
+	if err != nil {
+		return nil, fmt.Errorf("render %s email: %w", name, err)
+	}
+	err = tpl.html.ExecuteTemplate(&html, "layout", data)
+	if err != nil {
+		return nil, fmt.Errorf("render %s email: %w", name, err)
+	}
+	return &Email{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
+
+// sendTemplate renders the email called name and sends it.
+func (es EmailService) sendTemplate(to, name string, data any) error {
+	email, err := es.render(name, data)
+	if err != nil {
+		return err
+	}
+	email.To = to
+	email.From = es.setFrom(email)
+	return es.Send(email)
+}
+
+// EmailPreviews returns the names of every email that can be previewed.
+func (es EmailService) EmailPreviews() []string {
+	names := make([]string, 0, len(emailSamples))
+	for _, email := range emailSamples {
+		names = append(names, email.name)
+	}
+	return names
+}
+
+// PreviewEmail renders the email called name with sample data. ErrNotFound is
+// returned if there is no such email.
+func (es EmailService) PreviewEmail(name string) (*Email, error) {
+	for _, email := range emailSamples {
+		if email.name != name {
+			continue
+		}
+		preview, err := es.render(name, email.sample(es.ServerURL))
+		if err != nil {
+			return nil, fmt.Errorf("preview email: %w", err)
+		}
+		preview.From = es.setFrom(preview)
+		preview.To = "someone@example.com"
+		return preview, nil
+	}
+	return nil, ErrNotFound
+}
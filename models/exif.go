@@ -0,0 +1,419 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+var errNoExif = errors.New("models: no exif data")
+
+const (
+	// maxExifSize caps how much EXIF data is read from a PNG. EXIF in a JPEG
+	// can't be larger than a segment, which is 64kb.
+	maxExifSize = 1 << 20 // 1mb
+
+	// exifTimeLayout is how EXIF records dates and times.
+	exifTimeLayout = "2006:01:02 15:04:05"
+)
+
+// The EXIF tags that are read. IFD0 points to the Exif and GPS IFDs, which
+// hold the rest.
+const (
+	tagMake               = 0x010f
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExposureTime       = 0x829a
+	tagFNumber            = 0x829d
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920a
+	tagLensModel          = 0xa434
+	tagMakerNote          = 0x927c
+	tagBodySerialNumber   = 0xa431
+	tagLensSerialNumber   = 0xa435
+	tagCameraSerialNumber = 0xc62f
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+)
+
+var jpegExifHeader = []byte("Exif\x00\x00")
+
+// pngSignature starts every PNG.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// readExif returns the raw EXIF data, a TIFF structure, embedded in a JPEG or
+// PNG image. errNoExif is returned if there is none.
+func readExif(r io.Reader, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return readJPEGExif(bufio.NewReader(r))
+	case "image/png":
+		return readPNGExif(bufio.NewReader(r))
+	default:
+		return nil, errNoExif
+	}
+}
+
+// readJPEGExif looks for the APP1 segment holding the EXIF data among the
+// segments before the image data.
+func readJPEGExif(r *bufio.Reader) ([]byte, error) {
+	var soi [2]byte
+	_, err := io.ReadFull(r, soi[:])
+	if err != nil {
+		return nil, fmt.Errorf("read jpeg exif: %w", err)
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return nil, fmt.Errorf("read jpeg exif: not a jpeg")
+	}
+	for {
+		marker, err := readJPEGMarker(r)
+		if err != nil {
+			return nil, fmt.Errorf("read jpeg exif: %w", err)
+		}
+		switch {
+		case marker == 0xda || marker == 0xd9:
+			// The image data starts, or the image ends, without any EXIF.
+			return nil, errNoExif
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// These markers have no segment.
+			continue
+		}
+		var length uint16
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err != nil {
+			return nil, fmt.Errorf("read jpeg exif: %w", err)
+		}
+		if length < 2 {
+			return nil, fmt.Errorf("read jpeg exif: invalid segment length %d", length)
+		}
+		segment := make([]byte, length-2)
+		_, err = io.ReadFull(r, segment)
+		if err != nil {
+			return nil, fmt.Errorf("read jpeg exif: %w", err)
+		}
+		if marker == 0xe1 && bytes.HasPrefix(segment, jpegExifHeader) {
+			return segment[len(jpegExifHeader):], nil
+		}
+	}
+}
+
+// readJPEGMarker reads the next marker, skipping the 0xff fill bytes that may
+// come before it.
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xff {
+		return 0, fmt.Errorf("expected marker, got %#x", b)
+	}
+	for b == 0xff {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// readPNGExif looks for the eXIf chunk, which holds the EXIF data as is.
+func readPNGExif(r *bufio.Reader) ([]byte, error) {
+	var signature [8]byte
+	_, err := io.ReadFull(r, signature[:])
+	if err != nil {
+		return nil, fmt.Errorf("read png exif: %w", err)
+	}
+	if string(signature[:]) != pngSignature {
+		return nil, fmt.Errorf("read png exif: not a png")
+	}
+	for {
+		var header struct {
+			Length uint32
+			Type   [4]byte
+		}
+		err := binary.Read(r, binary.BigEndian, &header)
+		if err != nil {
+			return nil, fmt.Errorf("read png exif: %w", err)
+		}
+		switch string(header.Type[:]) {
+		case "IEND":
+			return nil, errNoExif
+		case "eXIf":
+			if header.Length > maxExifSize {
+				return nil, fmt.Errorf("read png exif: chunk too large")
+			}
+			data := make([]byte, header.Length)
+			_, err = io.ReadFull(r, data)
+			if err != nil {
+				return nil, fmt.Errorf("read png exif: %w", err)
+			}
+			return data, nil
+		}
+		// Skip the chunk's data and CRC.
+		_, err = r.Discard(int(header.Length) + 4)
+		if err != nil {
+			return nil, fmt.Errorf("read png exif: %w", err)
+		}
+	}
+}
+
+// parseExif reads the metadata photographers care about from EXIF data.
+// Fields that are missing or malformed are left empty.
+func parseExif(data []byte) (*ImageMetadata, error) {
+	t, ifd0Offset, err := newTIFF(data)
+	if err != nil {
+		return nil, fmt.Errorf("parse exif: %w", err)
+	}
+	ifd0, err := t.ifd(ifd0Offset)
+	if err != nil {
+		return nil, fmt.Errorf("parse exif: %w", err)
+	}
+	meta := ImageMetadata{
+		CameraMake:  t.string(ifd0[tagMake]),
+		CameraModel: t.string(ifd0[tagModel]),
+	}
+	if entry, ok := ifd0[tagExifIFD]; ok {
+		exif, err := t.ifd(t.uint(entry))
+		if err == nil {
+			meta.LensModel = t.string(exif[tagLensModel])
+			meta.ExposureTime = t.rational(exif[tagExposureTime])
+			meta.FNumber = t.rational(exif[tagFNumber])
+			meta.ISO = int(t.uint(exif[tagISO]))
+			meta.FocalLength = t.rational(exif[tagFocalLength])
+			meta.CapturedAt = parseExifTime(t.string(exif[tagDateTimeOriginal]), t.string(exif[tagOffsetTimeOriginal]))
+		}
+	}
+	if entry, ok := ifd0[tagGPSIFD]; ok {
+		gps, err := t.ifd(t.uint(entry))
+		if err == nil {
+			meta.Location = parseGPS(t, gps)
+		}
+	}
+	return &meta, nil
+}
+
+// parseExifTime parses the time a photo was taken. Cameras that record their
+// UTC offset get it applied. For the rest the time is the camera's clock,
+// stored as if it were UTC.
+func parseExifTime(value, offset string) time.Time {
+	if offset != "" {
+		t, err := time.Parse(exifTimeLayout+"-07:00", value+offset)
+		if err == nil {
+			return t.UTC()
+		}
+	}
+	t, err := time.Parse(exifTimeLayout, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func parseGPS(t tiff, gps map[uint16]tiffEntry) *GeoLocation {
+	lat, ok := gpsCoordinate(t, gps[tagGPSLatitude], t.string(gps[tagGPSLatitudeRef]), "S")
+	if !ok || math.Abs(lat) > 90 {
+		return nil
+	}
+	lng, ok := gpsCoordinate(t, gps[tagGPSLongitude], t.string(gps[tagGPSLongitudeRef]), "W")
+	if !ok || math.Abs(lng) > 180 {
+		return nil
+	}
+	return &GeoLocation{Latitude: lat, Longitude: lng}
+}
+
+// gpsCoordinate turns degrees, minutes and seconds into decimal degrees,
+// negative if ref is the negative direction.
+func gpsCoordinate(t tiff, entry tiffEntry, ref, negative string) (float64, bool) {
+	parts := t.rationals(entry)
+	if len(parts) != 3 || ref == "" {
+		return 0, false
+	}
+	for _, part := range parts {
+		if math.IsNaN(part) {
+			return 0, false
+		}
+	}
+	degrees := parts[0] + parts[1]/60 + parts[2]/3600
+	if strings.EqualFold(ref, negative) {
+		degrees = -degrees
+	}
+	return degrees, true
+}
+
+// tiff reads values out of the TIFF structure EXIF data is stored in.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// TIFF field types and how many bytes each value takes.
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffSByte     = 6
+	tiffUndefined = 7
+	tiffSShort    = 8
+	tiffSLong     = 9
+	tiffSRational = 10
+	tiffFloat     = 11
+	tiffDouble    = 12
+)
+
+var tiffTypeSizes = map[uint16]uint32{
+	tiffByte:      1,
+	tiffASCII:     1,
+	tiffShort:     2,
+	tiffLong:      4,
+	tiffRational:  8,
+	tiffSByte:     1,
+	tiffUndefined: 1,
+	tiffSShort:    2,
+	tiffSLong:     4,
+	tiffSRational: 8,
+	tiffFloat:     4,
+	tiffDouble:    8,
+}
+
+// newTIFF checks the header of the TIFF data and returns the offset of its
+// first IFD.
+func newTIFF(data []byte) (tiff, uint32, error) {
+	if len(data) < 8 {
+		return tiff{}, 0, fmt.Errorf("tiff header too short")
+	}
+	t := tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return tiff{}, 0, fmt.Errorf("invalid tiff byte order")
+	}
+	if t.order.Uint16(data[2:4]) != 42 {
+		return tiff{}, 0, fmt.Errorf("invalid tiff magic number")
+	}
+	return t, t.order.Uint32(data[4:8]), nil
+}
+
+// ifd reads the entries of the IFD at the offset, by tag. Entries of unknown
+// types or with values outside the data are skipped.
+func (t tiff) ifd(offset uint32) (map[uint16]tiffEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, fmt.Errorf("ifd offset out of range")
+	}
+	n := uint64(t.order.Uint16(t.data[offset:]))
+	start := uint64(offset) + 2
+	if start+n*12 > uint64(len(t.data)) {
+		return nil, fmt.Errorf("ifd entries out of range")
+	}
+	entries := make(map[uint16]tiffEntry, n)
+	for i := uint64(0); i < n; i++ {
+		raw := t.data[start+i*12 : start+i*12+12]
+		entry := tiffEntry{
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+		}
+		size, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		length := uint64(size) * uint64(entry.count)
+		if length <= 4 {
+			entry.value = raw[8 : 8+length]
+		} else {
+			valueOffset := uint64(t.order.Uint32(raw[8:12]))
+			if valueOffset+length > uint64(len(t.data)) {
+				continue
+			}
+			entry.value = t.data[valueOffset : valueOffset+length]
+		}
+		entries[t.order.Uint16(raw[0:2])] = entry
+	}
+	return entries, nil
+}
+
+// string returns an ASCII value without its trailing NUL and padding.
+func (t tiff) string(entry tiffEntry) string {
+	if entry.typ != tiffASCII {
+		return ""
+	}
+	value := string(entry.value)
+	if i := strings.IndexByte(value, 0); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// uint returns the first value of a BYTE, SHORT or LONG entry, or 0.
+func (t tiff) uint(entry tiffEntry) uint32 {
+	if entry.count == 0 {
+		return 0
+	}
+	switch entry.typ {
+	case tiffByte:
+		return uint32(entry.value[0])
+	case tiffShort:
+		return uint32(t.order.Uint16(entry.value))
+	case tiffLong:
+		return t.order.Uint32(entry.value)
+	default:
+		return 0
+	}
+}
+
+// rational returns the first value of a RATIONAL or SRATIONAL entry, or 0 if
+// there is none or it divides by zero.
+func (t tiff) rational(entry tiffEntry) float64 {
+	values := t.rationals(entry)
+	if len(values) == 0 || math.IsNaN(values[0]) {
+		return 0
+	}
+	return values[0]
+}
+
+// rationals returns the values of a RATIONAL or SRATIONAL entry. Values that
+// divide by zero are NaN.
+func (t tiff) rationals(entry tiffEntry) []float64 {
+	if entry.typ != tiffRational && entry.typ != tiffSRational {
+		return nil
+	}
+	values := make([]float64, entry.count)
+	for i := range values {
+		raw := entry.value[i*8 : i*8+8]
+		var num, den float64
+		if entry.typ == tiffRational {
+			num = float64(t.order.Uint32(raw[0:4]))
+			den = float64(t.order.Uint32(raw[4:8]))
+		} else {
+			num = float64(int32(t.order.Uint32(raw[0:4])))
+			den = float64(int32(t.order.Uint32(raw[4:8])))
+		}
+		if den == 0 {
+			values[i] = math.NaN()
+			continue
+		}
+		values[i] = num / den
+	}
+	return values
+}
@@ -4,45 +4,130 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"io"
-	"io/fs"
-	"os"
-	"path/filepath"
-	"strings"
 )
 
+// Visibility controls who can see a gallery.
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be seen by their owner, or with a
+	// share link.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be seen by anyone with the link, but
+	// are left out of listings and asked not to be indexed by search engines.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries are listed on the owner's profile and can be
+	// discovered by anyone.
+	VisibilityPublic Visibility = "public"
+)
+
+// Visibilities lists every visibility, in the order they are offered to
+// users.
+var Visibilities = []Visibility{VisibilityPrivate, VisibilityUnlisted, VisibilityPublic}
+
+// ParseVisibility returns the visibility called s, or an error if there is no
+// such visibility.
+func ParseVisibility(s string) (Visibility, error) {
+	for _, v := range Visibilities {
+		if string(v) == s {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("parse visibility: unknown visibility %q", s)
+}
+
 type Gallery struct {
-	ID        int
-	UserID    int
-	Title     string
-	Published bool
+	ID     int
+	UserID int
+	// PublicID identifies the gallery in URLs. Unlike ID it can't be guessed,
+	// so galleries can't be found by counting through them.
+	PublicID string
+	// Slug is built from the title and is unique among the owner's
+	// galleries. Public galleries can be found by it on the owner's profile.
+	Slug       string
+	Title      string
+	Visibility Visibility
+	// PassphraseHash is empty unless visitors need a passphrase to view the
+	// gallery.
+	PassphraseHash string
+	// CoverImageID is the image chosen to represent the gallery, or 0 to use
+	// its first image.
+	CoverImageID int
+	// ShowLocation lets viewers see where the gallery's photos were taken.
+	// Editors always can.
+	ShowLocation bool
+	// MetadataPolicy is the metadata removed from original images before
+	// they are served to anyone but the owner.
+	MetadataPolicy MetadataPolicy
 }
 
-type Image struct {
-	Path      string
-	Filename  string
-	GalleryID int
+// Protected reports whether the gallery has a passphrase.
+func (g Gallery) Protected() bool {
+	return g.PassphraseHash != ""
+}
+
+// Private reports whether only the owner can see the gallery.
+func (g Gallery) Private() bool {
+	return g.Visibility == VisibilityPrivate
+}
+
+// Listed reports whether the gallery may be shown in listings and indexed by
+// search engines.
+func (g Gallery) Listed() bool {
+	return g.Visibility == VisibilityPublic
 }
 
 type GalleryService struct {
 	DB *sql.DB
 
 	// ImagesDir is used to tell the GalleryService where to store and locate
-	// images. If not set, the GalleryService will default to using the "images"
-	// directory.
+	// images when no Store is set. If not set, the GalleryService will default
+	// to using the "images" directory.
 	ImagesDir string
+
+	// Store is where image files are kept. If not set, images are stored on
+	// the local disk in ImagesDir.
+	Store ImageStore
+
+	// Jobs is used to generate image variants in the background. If not set,
+	// variants are generated while the image is created.
+	Jobs *JobService
+
+	// UnlockKey signs the tokens that let visitors who entered the right
+	// passphrase view a protected gallery.
+	UnlockKey []byte
 }
 
-func (gs *GalleryService) Create(title string, userID int, published bool) (*Gallery, error) {
+func (gs *GalleryService) Create(title string, userID int, visibility Visibility) (*Gallery, error) {
+	publicID, err := newPublicID()
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
 	gallery := Gallery{
-		Title:     title,
-		UserID:    userID,
-		Published: published,
+		Title:          title,
+		UserID:         userID,
+		PublicID:       publicID,
+		Visibility:     visibility,
+		MetadataPolicy: MetadataStripLocation,
 	}
-	row := gs.DB.QueryRow(`
-		INSERT INTO galleries (user_id, title, published)
-		VALUES ($2, $1, $3) RETURNING id;`, title, userID, published)
-	err := row.Scan(&gallery.ID)
+	tx, err := gs.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	defer tx.Rollback()
+	gallery.Slug, err = uniqueGallerySlug(tx, userID, 0, GallerySlug(title))
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	row := tx.QueryRow(`
+		INSERT INTO galleries (user_id, title, visibility, public_id, slug, metadata_policy)
+		VALUES ($2, $1, $3, $4, $5, $6) RETURNING id;`, title, userID, visibility, gallery.PublicID,
+		gallery.Slug, gallery.MetadataPolicy)
+	err = row.Scan(&gallery.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	err = tx.Commit()
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
 	}
@@ -53,22 +138,29 @@ func (gs *GalleryService) ByID(id int) (*Gallery, error) {
 	gallery := Gallery{
 		ID: id,
 	}
+	var passphraseHash sql.NullString
+	var coverImageID sql.NullInt64
 	row := gs.DB.QueryRow(`
-		SELECT title, user_id, published
+		SELECT title, user_id, public_id, slug, visibility, passphrase_hash, cover_image_id, show_location,
+			metadata_policy
 		FROM galleries WHERE id = $1;`, id)
-	err := row.Scan(&gallery.Title, &gallery.UserID, &gallery.Published)
+	err := row.Scan(&gallery.Title, &gallery.UserID, &gallery.PublicID, &gallery.Slug,
+		&gallery.Visibility, &passphraseHash, &coverImageID, &gallery.ShowLocation,
+		&gallery.MetadataPolicy)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
 		}
 		return nil, fmt.Errorf("query gallery by id: %w", err)
 	}
+	gallery.PassphraseHash = passphraseHash.String
+	gallery.CoverImageID = int(coverImageID.Int64)
 	return &gallery, nil
 }
 
 func (gs *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	rows, err := gs.DB.Query(`
-		SELECT id, title, published
+		SELECT id, public_id, slug, title, visibility
 		FROM galleries
 		WHERE user_id = $1;`, userID)
 	if err != nil {
@@ -79,7 +171,7 @@ func (gs *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 		gallery := Gallery{
 			UserID: userID,
 		}
-		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Published)
+		err := rows.Scan(&gallery.ID, &gallery.PublicID, &gallery.Slug, &gallery.Title, &gallery.Visibility)
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user: %w", err)
 		}
@@ -91,130 +183,253 @@ func (gs *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	return galleries, nil
 }
 
-func (gs *GalleryService) Update(gallery *Gallery) error {
-	res, err := gs.DB.Exec(`
-		UPDATE galleries
-		SET title = $1, published = $2
-		WHERE id = $3;`, gallery.Title, gallery.Published, gallery.ID)
-	if err != nil {
-		return fmt.Errorf("update gallery: %w", err)
-	}
-	fmt.Println(res)
-	return nil
-}
-
-func (gs *GalleryService) Delete(id int) error {
-	_, err := gs.DB.Exec(`
-		DELETE FROM galleries
-		WHERE id = $1;`, id)
+// ByUserIDPage returns up to limit of the user's galleries, oldest first,
+// skipping the first offset, along with how many galleries the user has in
+// total.
+func (gs *GalleryService) ByUserIDPage(userID, limit, offset int) ([]Gallery, int, error) {
+	var total int
+	row := gs.DB.QueryRow(`
+		SELECT COUNT(*) FROM galleries WHERE user_id = $1;`, userID)
+	err := row.Scan(&total)
 	if err != nil {
-		return fmt.Errorf("delete gallery: %w", err)
+		return nil, 0, fmt.Errorf("query galleries page: %w", err)
 	}
-	err = os.RemoveAll(gs.galleryDir(id))
-	if err != nil {
-		return fmt.Errorf("delete gallery images: %w", err)
-	}
-	return nil
-}
-
-func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(service.galleryDir(galleryID), "*")
-	allFiles, err := filepath.Glob(globPattern)
+	rows, err := gs.DB.Query(`
+		SELECT id, public_id, slug, title, visibility, show_location, metadata_policy
+		FROM galleries
+		WHERE user_id = $1
+		ORDER BY id
+		LIMIT $2 OFFSET $3;`, userID, limit, offset)
 	if err != nil {
-		return nil, fmt.Errorf("receiving gallery images: %w", err)
+		return nil, 0, fmt.Errorf("query galleries page: %w", err)
 	}
-	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, service.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			UserID: userID,
 		}
+		err := rows.Scan(&gallery.ID, &gallery.PublicID, &gallery.Slug, &gallery.Title,
+			&gallery.Visibility, &gallery.ShowLocation, &gallery.MetadataPolicy)
+		if err != nil {
+			return nil, 0, fmt.Errorf("query galleries page: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("query galleries page: %w", err)
 	}
+	return galleries, total, nil
+}
 
-	return images, nil
+// ListedGallery is a gallery along with the image to show for it in
+// listings.
+type ListedGallery struct {
+	Gallery
+	// Cover is nil if the gallery has no images, or if it is protected by a
+	// passphrase and listed for anyone to see.
+	Cover *Image
 }
 
-func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(service.galleryDir(galleryID), filename)
-	_, err := os.Stat(imagePath)
+// ByUserIDWithCovers returns the user's galleries along with their covers,
+// for listing them to the user.
+func (gs *GalleryService) ByUserIDWithCovers(userID int) ([]ListedGallery, error) {
+	rows, err := gs.DB.Query(`
+		SELECT galleries.id,
+			galleries.public_id,
+			galleries.slug,
+			galleries.title,
+			galleries.visibility,
+			cover.filename,
+			cover.width,
+			cover.height,
+			cover.alt_text,
+			cover.title
+		FROM galleries
+		LEFT JOIN LATERAL (
+			SELECT filename, width, height, alt_text, title
+			FROM images
+			WHERE images.gallery_id = galleries.id
+			ORDER BY images.id IS NOT DISTINCT FROM galleries.cover_image_id DESC, position, id
+			LIMIT 1
+		) AS cover ON TRUE
+		WHERE galleries.user_id = $1
+		ORDER BY galleries.id;`, userID)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			return Image{}, fs.ErrNotExist
+		return nil, fmt.Errorf("query galleries with covers: %w", err)
+	}
+	defer rows.Close()
+	var galleries []ListedGallery
+	for rows.Next() {
+		gallery := ListedGallery{
+			Gallery: Gallery{
+				UserID: userID,
+			},
+		}
+		var cover coverColumns
+		err := rows.Scan(&gallery.ID, &gallery.PublicID, &gallery.Slug, &gallery.Title,
+			&gallery.Visibility, &cover.filename, &cover.width, &cover.height, &cover.altText, &cover.title)
+		if err != nil {
+			return nil, fmt.Errorf("query galleries with covers: %w", err)
 		}
-		return Image{}, fmt.Errorf("querying for image: %w", err)
+		gallery.Cover = cover.image(gallery.ID)
+		galleries = append(galleries, gallery)
 	}
-	return Image{
-		GalleryID: galleryID,
-		Path:      imagePath,
-		Filename:  filepath.Base(imagePath),
-	}, nil
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query galleries with covers: %w", err)
+	}
+	return galleries, nil
 }
 
-func (service *GalleryService) extensions() []string {
-	return []string{".png", ".jpg", ".jpeg", ".gif"}
+// coverColumns scans the columns of a gallery's cover that listings need,
+// which are all NULL if the gallery has no cover.
+type coverColumns struct {
+	filename, altText, title sql.NullString
+	width, height            sql.NullInt64
 }
 
-func (service GalleryService) galleryDir(id int) string {
-	imagesDir := service.ImagesDir
-	if imagesDir == "" {
-		imagesDir = "images"
+// image returns the cover, or nil if there is none.
+func (c coverColumns) image(galleryID int) *Image {
+	if !c.filename.Valid {
+		return nil
+	}
+	return &Image{
+		GalleryID: galleryID,
+		Filename:  c.filename.String,
+		Width:     int(c.width.Int64),
+		Height:    int(c.height.Int64),
+		AltText:   c.altText.String,
+		Title:     c.title.String,
 	}
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
 }
 
-func hasExtension(file string, extensions []string) bool {
-	for _, ext := range extensions {
-		file = strings.ToLower(file)
-		ext = strings.ToLower(ext)
-		if filepath.Ext(file) == ext {
-			return true
+// ListedByUserID returns the user's public galleries, newest first, along with
+// their covers.
+func (gs *GalleryService) ListedByUserID(userID int) ([]ListedGallery, error) {
+	rows, err := gs.DB.Query(`
+		SELECT galleries.id,
+			galleries.public_id,
+			galleries.slug,
+			galleries.title,
+			galleries.passphrase_hash,
+			cover.filename,
+			cover.width,
+			cover.height,
+			cover.alt_text,
+			cover.title
+		FROM galleries
+		LEFT JOIN LATERAL (
+			SELECT filename, width, height, alt_text, title
+			FROM images
+			WHERE images.gallery_id = galleries.id
+			ORDER BY images.id IS NOT DISTINCT FROM galleries.cover_image_id DESC, position, id
+			LIMIT 1
+		) AS cover ON galleries.passphrase_hash IS NULL
+		WHERE galleries.user_id = $1 AND galleries.visibility = $2
+		ORDER BY galleries.id DESC;`, userID, VisibilityPublic)
+	if err != nil {
+		return nil, fmt.Errorf("query listed galleries: %w", err)
+	}
+	defer rows.Close()
+	var galleries []ListedGallery
+	for rows.Next() {
+		gallery := ListedGallery{
+			Gallery: Gallery{
+				UserID:     userID,
+				Visibility: VisibilityPublic,
+			},
 		}
+		var passphraseHash sql.NullString
+		var cover coverColumns
+		err := rows.Scan(&gallery.ID, &gallery.PublicID, &gallery.Slug, &gallery.Title,
+			&passphraseHash, &cover.filename, &cover.width, &cover.height, &cover.altText, &cover.title)
+		if err != nil {
+			return nil, fmt.Errorf("query listed galleries: %w", err)
+		}
+		gallery.PassphraseHash = passphraseHash.String
+		gallery.Cover = cover.image(gallery.ID)
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query listed galleries: %w", err)
 	}
-	return false
+	return galleries, nil
 }
 
-func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
-	image, err := service.Image(galleryID, filename)
+// Update saves the gallery's title, visibility, whether it shows where its
+// photos were taken and its metadata policy. When the title changes, so does
+// the slug, and the old slug keeps redirecting to the gallery.
+func (gs *GalleryService) Update(gallery *Gallery) error {
+	tx, err := gs.DB.Begin()
 	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+		return fmt.Errorf("update gallery: %w", err)
 	}
-	err = os.Remove(image.Path)
+	defer tx.Rollback()
+	var userID int
+	var oldTitle, oldSlug string
+	row := tx.QueryRow(`
+		SELECT user_id, title, slug FROM galleries WHERE id = $1 FOR UPDATE;`, gallery.ID)
+	err = row.Scan(&userID, &oldTitle, &oldSlug)
 	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("update gallery: %w", err)
 	}
-	return nil
-}
-
-func (service *GalleryService) imageContentTypes() []string {
-	return []string{"image/jpeg", "image/png", "image/gif"}
-}
-
-func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) error {
-	err := checkContentType(contents, service.imageContentTypes())
-	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+	slug := oldSlug
+	if GallerySlug(gallery.Title) != GallerySlug(oldTitle) {
+		slug, err = uniqueGallerySlug(tx, userID, gallery.ID, GallerySlug(gallery.Title))
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		err = moveGallerySlug(tx, gallery.ID, userID, oldSlug, userID, slug)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
 	}
-	err = checkExtension(filename, service.extensions())
+	_, err = tx.Exec(`
+		UPDATE galleries
+		SET title = $1, visibility = $2, slug = $3, show_location = $4, metadata_policy = $5
+		WHERE id = $6;`, gallery.Title, gallery.Visibility, slug, gallery.ShowLocation,
+		gallery.MetadataPolicy, gallery.ID)
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return fmt.Errorf("update gallery: %w", err)
 	}
-	galleryDir := service.galleryDir(galleryID)
-	err = os.Mkdir(galleryDir, 0755)
+	err = tx.Commit()
 	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+		return fmt.Errorf("update gallery: %w", err)
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
+	gallery.Slug = slug
+	return nil
+}
+
+func (gs *GalleryService) Delete(id int) error {
+	_, err := gs.DB.Exec(`
+		DELETE FROM galleries
+		WHERE id = $1;`, id)
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		return fmt.Errorf("delete gallery: %w", err)
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, contents)
+	objects, err := gs.store().List(gs.galleryPrefix(id))
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return fmt.Errorf("delete gallery images: %w", err)
+	}
+	for _, object := range objects {
+		err = gs.store().Delete(object.Key)
+		if err != nil {
+			return fmt.Errorf("delete gallery images: %w", err)
+		}
 	}
 	return nil
 }
+
+func (service *GalleryService) store() ImageStore {
+	if service.Store == nil {
+		return &LocalImageStore{Dir: service.ImagesDir}
+	}
+	return service.Store
+}
+
+func (service *GalleryService) galleryPrefix(id int) string {
+	return fmt.Sprintf("gallery-%d/", id)
+}
@@ -0,0 +1,550 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAlreadyMember = errors.New("models: user is already a member of the gallery")
+	// ErrInvitationEmail is returned when a user accepts an invitation that
+	// was sent to a different email address than theirs.
+	ErrInvitationEmail = errors.New("models: invitation is for another email address")
+)
+
+// GalleryInvitationLifetime is how long an invitation to join a gallery can be
+// accepted for.
+const GalleryInvitationLifetime = 7 * 24 * time.Hour
+
+// GalleryRole is what a user can do with a gallery. Each role can do
+// everything the roles before it can.
+type GalleryRole string
+
+const (
+	// RoleViewer members can view the gallery even when it is private or
+	// protected by a passphrase.
+	RoleViewer GalleryRole = "viewer"
+	// RoleContributor members can also upload images.
+	RoleContributor GalleryRole = "contributor"
+	// RoleEditor members can also edit the gallery, manage how it is shared
+	// and delete images.
+	RoleEditor GalleryRole = "editor"
+	// RoleOwner is the role of the gallery's UserID. It is never stored for a
+	// member: the owner can also delete the gallery, manage its members and
+	// hand it over to one of them.
+	RoleOwner GalleryRole = "owner"
+)
+
+// GalleryRoles lists the roles members can be given, in the order they are
+// offered to users.
+var GalleryRoles = []GalleryRole{RoleViewer, RoleContributor, RoleEditor}
+
+// ParseGalleryRole returns the member role called s, or an error if there is
+// no such role.
+func ParseGalleryRole(s string) (GalleryRole, error) {
+	for _, role := range GalleryRoles {
+		if string(role) == s {
+			return role, nil
+		}
+	}
+	return "", fmt.Errorf("parse gallery role: unknown role %q", s)
+}
+
+// Includes reports whether the role can do everything other can. The empty
+// role, for users who are not members, includes nothing.
+func (r GalleryRole) Includes(other GalleryRole) bool {
+	return r.rank() >= other.rank() && r.rank() > 0
+}
+
+func (r GalleryRole) rank() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleContributor:
+		return 2
+	case RoleEditor:
+		return 3
+	case RoleOwner:
+		return 4
+	default:
+		return 0
+	}
+}
+
+type GalleryMember struct {
+	GalleryID int
+	UserID    int
+	Email     string
+	Role      GalleryRole
+	CreatedAt time.Time
+}
+
+// SharedGallery is a gallery that a user is a member of, along with their role.
+type SharedGallery struct {
+	Gallery
+	Role GalleryRole
+	// Cover is nil if the gallery has no images.
+	Cover *Image
+}
+
+// GalleryInvitation asks the user with the email address Email to join a
+// gallery. It is accepted with its token, which is sent to that address.
+type GalleryInvitation struct {
+	ID              int
+	GalleryID       int
+	GalleryPublicID string
+	GalleryTitle    string
+	Email           string
+	Role            GalleryRole
+	// Token is only set when the invitation is created. Only the hash is
+	// stored.
+	Token     string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type GalleryMemberService struct {
+	DB           *sql.DB
+	TokenManager *TokenManager
+}
+
+// Role returns the user's role in the gallery, or the empty role if the user
+// is not a member.
+func (gms *GalleryMemberService) Role(gallery *Gallery, userID int) (GalleryRole, error) {
+	if gallery.UserID == userID {
+		return RoleOwner, nil
+	}
+	var role GalleryRole
+	row := gms.DB.QueryRow(`
+		SELECT role
+		FROM gallery_members
+		WHERE gallery_id = $1 AND user_id = $2;`, gallery.ID, userID)
+	err := row.Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("query gallery role: %w", err)
+	}
+	return role, nil
+}
+
+// Members returns the gallery's members, not including its owner, in the
+// order they joined.
+func (gms *GalleryMemberService) Members(galleryID int) ([]GalleryMember, error) {
+	rows, err := gms.DB.Query(`
+		SELECT gallery_members.user_id,
+			users.email,
+			gallery_members.role,
+			gallery_members.created_at
+		FROM gallery_members
+		JOIN users ON users.id = gallery_members.user_id
+		WHERE gallery_members.gallery_id = $1
+		ORDER BY gallery_members.created_at, gallery_members.user_id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query gallery members: %w", err)
+	}
+	defer rows.Close()
+	var members []GalleryMember
+	for rows.Next() {
+		member := GalleryMember{
+			GalleryID: galleryID,
+		}
+		err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query gallery members: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query gallery members: %w", err)
+	}
+	return members, nil
+}
+
+// Shared returns the galleries the user is a member of, but does not own,
+// along with their covers.
+func (gms *GalleryMemberService) Shared(userID int) ([]SharedGallery, error) {
+	rows, err := gms.DB.Query(`
+		SELECT galleries.id,
+			galleries.user_id,
+			galleries.public_id,
+			galleries.slug,
+			galleries.title,
+			galleries.visibility,
+			gallery_members.role,
+			cover.filename,
+			cover.width,
+			cover.height,
+			cover.alt_text,
+			cover.title
+		FROM gallery_members
+		JOIN galleries ON galleries.id = gallery_members.gallery_id
+		LEFT JOIN LATERAL (
+			SELECT filename, width, height, alt_text, title
+			FROM images
+			WHERE images.gallery_id = galleries.id
+			ORDER BY images.id IS NOT DISTINCT FROM galleries.cover_image_id DESC, position, id
+			LIMIT 1
+		) AS cover ON TRUE
+		WHERE gallery_members.user_id = $1
+		ORDER BY galleries.id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query shared galleries: %w", err)
+	}
+	defer rows.Close()
+	var galleries []SharedGallery
+	for rows.Next() {
+		var shared SharedGallery
+		var cover coverColumns
+		err := rows.Scan(&shared.ID, &shared.UserID, &shared.PublicID, &shared.Slug,
+			&shared.Title, &shared.Visibility, &shared.Role,
+			&cover.filename, &cover.width, &cover.height, &cover.altText, &cover.title)
+		if err != nil {
+			return nil, fmt.Errorf("query shared galleries: %w", err)
+		}
+		shared.Cover = cover.image(shared.ID)
+		galleries = append(galleries, shared)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query shared galleries: %w", err)
+	}
+	return galleries, nil
+}
+
+// SetRole changes the role of one of the gallery's members. ErrNotFound is
+// returned if the user is not a member.
+func (gms *GalleryMemberService) SetRole(galleryID, userID int, role GalleryRole) error {
+	row := gms.DB.QueryRow(`
+		UPDATE gallery_members
+		SET role = $3
+		WHERE gallery_id = $1 AND user_id = $2
+		RETURNING user_id;`, galleryID, userID, role)
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("set gallery role: %w", err)
+	}
+	return nil
+}
+
+// Remove takes the user out of the gallery's members. ErrNotFound is returned
+// if the user is not a member.
+func (gms *GalleryMemberService) Remove(galleryID, userID int) error {
+	row := gms.DB.QueryRow(`
+		DELETE FROM gallery_members
+		WHERE gallery_id = $1 AND user_id = $2
+		RETURNING user_id;`, galleryID, userID)
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("remove gallery member: %w", err)
+	}
+	return nil
+}
+
+// TransferOwnership makes one of the gallery's members its owner. The old
+// owner stays on as an editor. ErrNotFound is returned if newOwnerID is not a
+// member or oldOwnerID no longer owns the gallery.
+func (gms *GalleryMemberService) TransferOwnership(galleryID, oldOwnerID, newOwnerID int) error {
+	tx, err := gms.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow(`
+		DELETE FROM gallery_members
+		WHERE gallery_id = $1 AND user_id = $2
+		RETURNING user_id;`, galleryID, newOwnerID)
+	err = row.Scan(&newOwnerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	var oldSlug string
+	row = tx.QueryRow(`
+		SELECT slug FROM galleries
+		WHERE id = $1 AND user_id = $2
+		FOR UPDATE;`, galleryID, oldOwnerID)
+	err = row.Scan(&oldSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	// The gallery keeps its slug unless the new owner already has a gallery
+	// by that name. Links under the old owner's profile keep working.
+	newSlug, err := uniqueGallerySlug(tx, newOwnerID, galleryID, oldSlug)
+	if err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	err = moveGallerySlug(tx, galleryID, oldOwnerID, oldSlug, newOwnerID, newSlug)
+	if err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	_, err = tx.Exec(`
+		UPDATE galleries
+		SET user_id = $2, slug = $3
+		WHERE id = $1;`, galleryID, newOwnerID, newSlug)
+	if err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO gallery_members (gallery_id, user_id, role)
+		VALUES ($1, $2, $3);`, galleryID, oldOwnerID, RoleEditor)
+	if err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("transfer gallery: %w", err)
+	}
+	return nil
+}
+
+// Invite creates an invitation for the email address to join the gallery with
+// the role. It replaces any earlier invitation to the same address, so only
+// the most recent link that was emailed works. ErrAlreadyMember is returned if
+// the address belongs to the owner or a member of the gallery.
+func (gms *GalleryMemberService) Invite(gallery *Gallery, invitedBy int, email string, role GalleryRole) (*GalleryInvitation, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	var member bool
+	row := gms.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM users
+			LEFT JOIN gallery_members
+				ON gallery_members.user_id = users.id AND gallery_members.gallery_id = $1
+			WHERE users.email = $2
+				AND (users.id = $3 OR gallery_members.user_id IS NOT NULL)
+		);`, gallery.ID, email, gallery.UserID)
+	err := row.Scan(&member)
+	if err != nil {
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	if member {
+		return nil, ErrAlreadyMember
+	}
+	token, tokenHash, err := gms.tokenManager().New()
+	if err != nil {
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	invitation := GalleryInvitation{
+		GalleryID:       gallery.ID,
+		GalleryPublicID: gallery.PublicID,
+		GalleryTitle:    gallery.Title,
+		Email:           email,
+		Role:            role,
+		Token:           token,
+		TokenHash:       tokenHash,
+		ExpiresAt:       time.Now().Add(GalleryInvitationLifetime),
+	}
+	row = gms.DB.QueryRow(`
+		INSERT INTO gallery_invitations (gallery_id, email, role, invited_by, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (gallery_id, email) DO UPDATE
+		SET role = EXCLUDED.role,
+			invited_by = EXCLUDED.invited_by,
+			token_hash = EXCLUDED.token_hash,
+			created_at = NOW(),
+			expires_at = EXCLUDED.expires_at
+		RETURNING id, created_at;`,
+		gallery.ID, email, role, invitedBy, tokenHash, invitation.ExpiresAt)
+	err = row.Scan(&invitation.ID, &invitation.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("invite gallery member: %w", err)
+	}
+	return &invitation, nil
+}
+
+// Invitations returns the gallery's unexpired invitations, newest first.
+func (gms *GalleryMemberService) Invitations(galleryID int) ([]GalleryInvitation, error) {
+	rows, err := gms.DB.Query(`
+		SELECT id, email, role, created_at, expires_at
+		FROM gallery_invitations
+		WHERE gallery_id = $1 AND expires_at > NOW()
+		ORDER BY created_at DESC, id DESC;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query gallery invitations: %w", err)
+	}
+	defer rows.Close()
+	var invitations []GalleryInvitation
+	for rows.Next() {
+		invitation := GalleryInvitation{
+			GalleryID: galleryID,
+		}
+		err := rows.Scan(&invitation.ID, &invitation.Email, &invitation.Role,
+			&invitation.CreatedAt, &invitation.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("query gallery invitations: %w", err)
+		}
+		invitations = append(invitations, invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query gallery invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+// Invitation looks up the invitation with the token without accepting it.
+// ErrNotFound is returned for unknown or revoked tokens and ErrTokenExpired for
+// expired ones.
+func (gms *GalleryMemberService) Invitation(token string) (*GalleryInvitation, error) {
+	invitation := GalleryInvitation{
+		TokenHash: gms.tokenManager().Hash(token),
+	}
+	row := gms.DB.QueryRow(`
+		SELECT gallery_invitations.id,
+			gallery_invitations.gallery_id,
+			galleries.public_id,
+			galleries.title,
+			gallery_invitations.email,
+			gallery_invitations.role,
+			gallery_invitations.created_at,
+			gallery_invitations.expires_at
+		FROM gallery_invitations
+		JOIN galleries ON galleries.id = gallery_invitations.gallery_id
+		WHERE gallery_invitations.token_hash = $1;`, invitation.TokenHash)
+	err := row.Scan(&invitation.ID, &invitation.GalleryID, &invitation.GalleryPublicID, &invitation.GalleryTitle,
+		&invitation.Email, &invitation.Role, &invitation.CreatedAt, &invitation.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery invitation: %w", err)
+	}
+	if time.Now().After(invitation.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return &invitation, nil
+}
+
+// Accept uses up the invitation with the token and makes the user a member of
+// its gallery. A user who is already a member gets the invitation's role.
+// Only the user with the email address the invitation was sent to can accept
+// it, so a forwarded or leaked link is no use to anyone else. Errors are the
+// same as for Invitation, plus ErrInvitationEmail if the user has a different
+// email address and ErrAlreadyMember if the user owns the gallery.
+func (gms *GalleryMemberService) Accept(token string, user *User) (*GalleryInvitation, error) {
+	invitation, err := gms.Invitation(token)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(invitation.Email, user.Email) {
+		return nil, ErrInvitationEmail
+	}
+	userID := user.ID
+	tx, err := gms.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	defer tx.Rollback()
+	// Deleting the invitation first makes sure that it is only used once,
+	// even if it is accepted twice at the same time.
+	row := tx.QueryRow(`
+		DELETE FROM gallery_invitations
+		WHERE id = $1 AND token_hash = $2
+		RETURNING id;`, invitation.ID, invitation.TokenHash)
+	err = row.Scan(&invitation.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	var owner bool
+	row = tx.QueryRow(`
+		SELECT user_id = $2 FROM galleries WHERE id = $1;`, invitation.GalleryID, userID)
+	err = row.Scan(&owner)
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	if owner {
+		return nil, ErrAlreadyMember
+	}
+	_, err = tx.Exec(`
+		INSERT INTO gallery_members (gallery_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (gallery_id, user_id) DO UPDATE
+		SET role = EXCLUDED.role;`, invitation.GalleryID, userID, invitation.Role)
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("accept gallery invitation: %w", err)
+	}
+	return invitation, nil
+}
+
+// RevokeInvitation deletes one of the gallery's invitations so that it can no
+// longer be accepted. ErrNotFound is returned if the invitation does not exist
+// or belongs to another gallery.
+func (gms *GalleryMemberService) RevokeInvitation(galleryID, id int) error {
+	row := gms.DB.QueryRow(`
+		DELETE FROM gallery_invitations
+		WHERE id = $1 AND gallery_id = $2
+		RETURNING id;`, id, galleryID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("revoke gallery invitation: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes expired invitations and returns how many were removed.
+func (gms *GalleryMemberService) DeleteExpired() (int64, error) {
+	res, err := gms.DB.Exec(`
+		DELETE FROM gallery_invitations
+		WHERE expires_at <= NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired gallery invitations: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired gallery invitations: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep calls DeleteExpired every interval until the context is cancelled.
+func (gms *GalleryMemberService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := gms.DeleteExpired()
+		if err != nil {
+			log.Printf("sweeping gallery invitations: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d expired gallery invitations", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (gms *GalleryMemberService) tokenManager() *TokenManager {
+	if gms.TokenManager == nil {
+		return &TokenManager{}
+	}
+	return gms.TokenManager
+}
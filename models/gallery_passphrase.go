@@ -0,0 +1,87 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// GalleryUnlockLifetime is how long a visitor can view a protected gallery
+// after entering its passphrase.
+const GalleryUnlockLifetime = 7 * 24 * time.Hour
+
+// SetPassphrase protects the gallery with the passphrase. An empty passphrase
+// removes the protection. Changing or removing the passphrase invalidates
+// every unlock token that was handed out for the old one.
+func (gs *GalleryService) SetPassphrase(galleryID int, passphrase string) error {
+	var passphraseHash *string
+	if passphrase != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("set gallery passphrase: %w", err)
+		}
+		str := string(hash)
+		passphraseHash = &str
+	}
+	_, err := gs.DB.Exec(`
+		UPDATE galleries
+		SET passphrase_hash = $2
+		WHERE id = $1;`, galleryID, passphraseHash)
+	if err != nil {
+		return fmt.Errorf("set gallery passphrase: %w", err)
+	}
+	return nil
+}
+
+// CheckPassphrase returns ErrPasswordMismatch unless the passphrase is the
+// gallery's.
+func (gs *GalleryService) CheckPassphrase(gallery *Gallery, passphrase string) error {
+	if !gallery.Protected() {
+		return nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(gallery.PassphraseHash), []byte(passphrase))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return fmt.Errorf("check gallery passphrase: %w", err)
+	}
+	return nil
+}
+
+// UnlockToken returns a token proving that the passphrase of the gallery was
+// entered, to be kept by the visitor until it expires.
+func (gs *GalleryService) UnlockToken(gallery *Gallery) (token string, expiresAt time.Time) {
+	expiresAt = time.Now().Add(GalleryUnlockLifetime)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expires + "." + gs.signUnlock(gallery, expires), expiresAt
+}
+
+// Unlocked reports whether the token is an unexpired unlock token for the
+// gallery's current passphrase.
+func (gs *GalleryService) Unlocked(gallery *Gallery, token string) bool {
+	expires, sig, found := strings.Cut(token, ".")
+	if !found {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(gs.signUnlock(gallery, expires)))
+}
+
+// signUnlock signs over the passphrase hash so that tokens stop working when
+// the passphrase changes.
+func (gs *GalleryService) signUnlock(gallery *Gallery, expires string) string {
+	mac := hmac.New(sha256.New, gs.UnlockKey)
+	fmt.Fprintf(mac, "gallery-unlock:%d:%s:%s", gallery.ID, expires, gallery.PassphraseHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/silasburger/lenslocked/rand"
+)
+
+const (
+	// MaxGallerySlugLength is how much of a gallery's title ends up in its
+	// slug.
+	MaxGallerySlugLength = 60
+
+	// publicIDBytes is the number of random bytes in a gallery's public ID,
+	// which makes for 12 URL safe characters.
+	publicIDBytes = 9
+
+	// maxGallerySlugTries is how many numbered slugs are tried before giving
+	// up on an owner with that many galleries of the same name.
+	maxGallerySlugTries = 100
+)
+
+var gallerySlugSeparators = regexp.MustCompile(`[^a-z0-9]+`)
+
+// reservedGallerySlugs are taken by other pages under a user's profile, so no
+// gallery can have them.
+var reservedGallerySlugs = map[string]bool{
+	"avatar": true,
+}
+
+// GallerySlug turns a gallery's title into the slug its URL is built from,
+// so that "Smith Wedding!" becomes "smith-wedding". Titles without any
+// letters or digits get the slug "gallery".
+func GallerySlug(title string) string {
+	slug := gallerySlugSeparators.ReplaceAllString(strings.ToLower(title), "-")
+	if len(slug) > MaxGallerySlugLength {
+		slug = slug[:MaxGallerySlugLength]
+	}
+	slug = strings.Trim(slug, "-")
+	if slug == "" {
+		return "gallery"
+	}
+	return slug
+}
+
+// newPublicID returns an unguessable ID to use for a gallery in URLs instead
+// of its sequential one.
+func newPublicID() (string, error) {
+	id, err := rand.String(publicIDBytes)
+	if err != nil {
+		return "", fmt.Errorf("new public id: %w", err)
+	}
+	return id, nil
+}
+
+func (gs *GalleryService) ByPublicID(publicID string) (*Gallery, error) {
+	gallery := Gallery{
+		PublicID: publicID,
+	}
+	var passphraseHash sql.NullString
+	var coverImageID sql.NullInt64
+	row := gs.DB.QueryRow(`
+		SELECT id, title, user_id, slug, visibility, passphrase_hash, cover_image_id, show_location,
+			metadata_policy
+		FROM galleries WHERE public_id = $1;`, publicID)
+	err := row.Scan(&gallery.ID, &gallery.Title, &gallery.UserID, &gallery.Slug,
+		&gallery.Visibility, &passphraseHash, &coverImageID, &gallery.ShowLocation,
+		&gallery.MetadataPolicy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery by public id: %w", err)
+	}
+	gallery.PassphraseHash = passphraseHash.String
+	gallery.CoverImageID = int(coverImageID.Int64)
+	return &gallery, nil
+}
+
+// BySlug returns the gallery of the user with the slug. Galleries that
+// changed their slug are also found by their old ones, even after they were
+// handed over to another owner; callers can compare the user and slug to the
+// returned gallery's UserID and Slug to redirect to the current ones.
+func (gs *GalleryService) BySlug(userID int, slug string) (*Gallery, error) {
+	var id int
+	row := gs.DB.QueryRow(`
+		SELECT id FROM galleries WHERE user_id = $1 AND slug = $2
+		UNION ALL
+		SELECT gallery_id FROM gallery_slug_redirects WHERE user_id = $1 AND slug = $2
+		LIMIT 1;`, userID, slug)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query gallery by slug: %w", err)
+	}
+	return gs.ByID(id)
+}
+
+// uniqueGallerySlug returns base, or base with a number appended, whichever
+// comes first that is not reserved and none of the user's other galleries use
+// or used to use.
+// galleryID is the gallery the slug is for, or 0 for a new gallery.
+func uniqueGallerySlug(tx *sql.Tx, userID, galleryID int, base string) (string, error) {
+	for i := 1; i <= maxGallerySlugTries; i++ {
+		slug := base
+		if i > 1 {
+			slug = fmt.Sprintf("%s-%d", base, i)
+		}
+		if reservedGallerySlugs[slug] {
+			continue
+		}
+		var taken bool
+		row := tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM galleries
+				WHERE user_id = $1 AND slug = $2 AND id <> $3
+			) OR EXISTS (
+				SELECT 1 FROM gallery_slug_redirects
+				WHERE user_id = $1 AND slug = $2 AND gallery_id <> $3
+			);`, userID, slug, galleryID)
+		err := row.Scan(&taken)
+		if err != nil {
+			return "", fmt.Errorf("unique gallery slug: %w", err)
+		}
+		if !taken {
+			return slug, nil
+		}
+	}
+	return "", fmt.Errorf("unique gallery slug: no free slug for %q", base)
+}
+
+// moveGallerySlug keeps the gallery's old slug under its old owner as a
+// redirect to the gallery, and releases the new slug if it was one of the
+// gallery's own old slugs under the new owner.
+func moveGallerySlug(tx *sql.Tx, galleryID, oldUserID int, oldSlug string, newUserID int, newSlug string) error {
+	_, err := tx.Exec(`
+		DELETE FROM gallery_slug_redirects
+		WHERE user_id = $1 AND slug = $2 AND gallery_id = $3;`, newUserID, newSlug, galleryID)
+	if err != nil {
+		return fmt.Errorf("move gallery slug: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO gallery_slug_redirects (user_id, slug, gallery_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, slug) DO NOTHING;`, oldUserID, oldSlug, galleryID)
+	if err != nil {
+		return fmt.Errorf("move gallery slug: %w", err)
+	}
+	return nil
+}
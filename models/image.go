@@ -0,0 +1,453 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxImagePixels is the most pixels an uploaded image or avatar can have.
+// Decoding an image takes 4 bytes of memory per pixel, with more for resizing
+// it, so this keeps small files with huge dimensions from using up the memory
+// of the server or worker.
+const MaxImagePixels = 40_000_000
+
+type Image struct {
+	ID        int
+	GalleryID int
+	// UserID is the user who uploaded the image. It is 0 if that user has
+	// since been deleted.
+	UserID   int
+	Filename string
+	// Key identifies the image in the GalleryService's ImageStore.
+	Key         string
+	ContentType string
+	Size        int64
+	Width       int
+	Height      int
+	// Position orders the images in the gallery, lowest first.
+	Position  int
+	Title     string
+	Caption   string
+	AltText   string
+	CreatedAt time.Time
+}
+
+// Alt is the text to show in place of the image: its alt text, or its title
+// if it has none.
+func (i Image) Alt() string {
+	if i.AltText != "" {
+		return i.AltText
+	}
+	return i.Title
+}
+
+func (service *GalleryService) Images(galleryID int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, user_id, filename, storage_key, content_type, size, width, height,
+			position, title, caption, alt_text, created_at
+		FROM images
+		WHERE gallery_id = $1
+		ORDER BY position, id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query images by gallery: %w", err)
+	}
+	images, err := scanImages(rows, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query images by gallery: %w", err)
+	}
+	return images, nil
+}
+
+// ImagesPage returns up to limit of the gallery's images, skipping the first
+// offset, along with how many images the gallery has in total.
+func (service *GalleryService) ImagesPage(galleryID, limit, offset int) ([]Image, int, error) {
+	var total int
+	row := service.DB.QueryRow(`
+		SELECT COUNT(*) FROM images WHERE gallery_id = $1;`, galleryID)
+	err := row.Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query images page: %w", err)
+	}
+	rows, err := service.DB.Query(`
+		SELECT id, user_id, filename, storage_key, content_type, size, width, height,
+			position, title, caption, alt_text, created_at
+		FROM images
+		WHERE gallery_id = $1
+		ORDER BY position, id
+		LIMIT $2 OFFSET $3;`, galleryID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query images page: %w", err)
+	}
+	images, err := scanImages(rows, galleryID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query images page: %w", err)
+	}
+	return images, total, nil
+}
+
+func scanImages(rows *sql.Rows, galleryID int) ([]Image, error) {
+	defer rows.Close()
+	var images []Image
+	for rows.Next() {
+		image := Image{
+			GalleryID: galleryID,
+		}
+		var userID sql.NullInt64
+		err := rows.Scan(&image.ID, &userID, &image.Filename, &image.Key, &image.ContentType,
+			&image.Size, &image.Width, &image.Height,
+			&image.Position, &image.Title, &image.Caption, &image.AltText, &image.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		image.UserID = int(userID.Int64)
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
+	image := Image{
+		GalleryID: galleryID,
+	}
+	var userID sql.NullInt64
+	row := service.DB.QueryRow(`
+		SELECT id, user_id, filename, storage_key, content_type, size, width, height,
+			position, title, caption, alt_text, created_at
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2;`, galleryID, path.Base(filename))
+	err := row.Scan(&image.ID, &userID, &image.Filename, &image.Key, &image.ContentType,
+		&image.Size, &image.Width, &image.Height,
+		&image.Position, &image.Title, &image.Caption, &image.AltText, &image.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("querying for image: %w", err)
+	}
+	image.UserID = int(userID.Int64)
+	return image, nil
+}
+
+// OpenImage returns the contents of the image from the image store. Callers
+// must close the returned io.ReadCloser. Depending on the store it may also
+// implement io.Seeker.
+//
+// size selects one of the resized variants, such as ImageSizeThumb. The
+// original is returned if size is empty or the image has no such variant.
+func (service *GalleryService) OpenImage(image Image, size string) (io.ReadCloser, ObjectInfo, error) {
+	if IsImageSize(size) {
+		contents, info, err := service.store().Get(service.variantKey(image, size))
+		if err == nil {
+			return contents, info, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, fmt.Errorf("opening image: %w", err)
+		}
+	}
+	contents, info, err := service.store().Get(image.Key)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, fs.ErrNotExist
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("opening image: %w", err)
+	}
+	return contents, info, nil
+}
+
+func (service *GalleryService) extensions() []string {
+	return []string{".png", ".jpg", ".jpeg", ".gif"}
+}
+
+func (service *GalleryService) imageKey(galleryID int, filename string) string {
+	return service.galleryPrefix(galleryID) + path.Base(filename)
+}
+
+func hasExtension(file string, extensions []string) bool {
+	for _, ext := range extensions {
+		file = strings.ToLower(file)
+		ext = strings.ToLower(ext)
+		if filepath.Ext(file) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
+	image, err := service.Image(galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		DELETE FROM images
+		WHERE id = $1;`, image.ID)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	err = service.store().Delete(image.Key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	err = service.deleteVariants(image)
+	if err != nil {
+		return fmt.Errorf("deleting image: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryService) imageContentTypes() []string {
+	return []string{"image/jpeg", "image/png", "image/gif"}
+}
+
+// CreateImage stores the image contents, records the image and its EXIF
+// metadata in the database and generates its resized variants, either right
+// away or in the background when the GalleryService has a JobService.
+// Uploading a file with the same name as an existing image in the gallery
+// replaces it.
+func (service *GalleryService) CreateImage(galleryID, userID int, filename string, contents io.ReadSeeker) (*Image, error) {
+	err := checkContentType(contents, service.imageContentTypes())
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = checkExtension(filename, service.extensions())
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	img := Image{
+		GalleryID: galleryID,
+		UserID:    userID,
+		Filename:  path.Base(filename),
+		Key:       service.imageKey(galleryID, filename),
+	}
+	err = readImageInfo(contents, &img)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	meta, err := readMetadata(contents, img.ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = service.store().Put(img.Key, contents)
+	if err != nil {
+		return nil, fmt.Errorf("storing image: %w", err)
+	}
+	err = service.insertImage(&img)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = service.saveMetadata(img.ID, meta)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if service.Jobs != nil {
+		_, err = service.Jobs.Enqueue(JobGenerateVariants, generateVariantsJob{
+			GalleryID: img.GalleryID,
+			Filename:  img.Filename,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+		return &img, nil
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	err = service.createVariants(img, contents)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	return &img, nil
+}
+
+func (service *GalleryService) insertImage(img *Image) error {
+	var userID sql.NullInt64
+	if img.UserID != 0 {
+		userID = sql.NullInt64{Int64: int64(img.UserID), Valid: true}
+	}
+	createdAt := img.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	// New images go after the gallery's other images. Replaced images keep
+	// their place, title, caption and alt text.
+	row := service.DB.QueryRow(`
+		INSERT INTO images (gallery_id, user_id, filename, storage_key, content_type, size, width, height, created_at, position)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9,
+			(SELECT COALESCE(MAX(position), 0) + 1 FROM images WHERE gallery_id = $1))
+		ON CONFLICT (gallery_id, filename) DO
+		UPDATE
+		SET user_id = $2, storage_key = $4, content_type = $5, size = $6,
+			width = $7, height = $8, created_at = $9
+		RETURNING id, position, title, caption, alt_text, created_at;`,
+		img.GalleryID, userID, img.Filename, img.Key, img.ContentType,
+		img.Size, img.Width, img.Height, createdAt)
+	err := row.Scan(&img.ID, &img.Position, &img.Title, &img.Caption, &img.AltText, &img.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	return nil
+}
+
+// readImageInfo fills in the content type, size and dimensions of img from
+// the contents, leaving contents positioned at the start.
+func readImageInfo(contents io.ReadSeeker, img *Image) error {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(contents, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("reading image info: %w", err)
+	}
+	img.ContentType = http.DetectContentType(header[:n])
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("reading image info: %w", err)
+	}
+	config, _, err := image.DecodeConfig(contents)
+	if err != nil {
+		return FileError{Issue: fmt.Sprintf("decoding image: %v", err)}
+	}
+	err = checkPixels(config)
+	if err != nil {
+		return err
+	}
+	img.Width = config.Width
+	img.Height = config.Height
+	img.Size, err = contents.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("reading image info: %w", err)
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("reading image info: %w", err)
+	}
+	return nil
+}
+
+// checkPixels returns a FileError if the image has more than MaxImagePixels.
+func checkPixels(config image.Config) error {
+	if config.Width*config.Height > MaxImagePixels {
+		return FileError{Issue: fmt.Sprintf("image is %dx%d, which is more than %d pixels", config.Width, config.Height, MaxImagePixels)}
+	}
+	return nil
+}
+
+// decodeImage decodes the image in r, after checking from its header that it
+// doesn't have more than MaxImagePixels. A FileError is returned if it can't
+// be decoded or is too large.
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	// The header is read twice, once for the dimensions and again to decode
+	// the image.
+	var header bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, "", FileError{Issue: fmt.Sprintf("decoding image: %v", err)}
+	}
+	err = checkPixels(config)
+	if err != nil {
+		return nil, "", err
+	}
+	src, format, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, "", FileError{Issue: fmt.Sprintf("decoding image: %v", err)}
+	}
+	return src, format, nil
+}
+
+// ReconcileImages scans the image store for files that have no row in the
+// images table, such as images uploaded before the table existed, and adds
+// rows for them. Files in galleries that no longer exist are skipped. It
+// returns the number of images added, along with why each file that couldn't
+// be read as an image was skipped. The rest are still added.
+func (service *GalleryService) ReconcileImages() (added int, skipped []error, err error) {
+	objects, err := service.store().List("")
+	if err != nil {
+		return 0, nil, fmt.Errorf("reconcile images: %w", err)
+	}
+	for _, object := range objects {
+		galleryID, filename, ok := parseImageKey(object.Key)
+		if !ok || !hasExtension(filename, service.extensions()) {
+			continue
+		}
+		gallery, err := service.ByID(galleryID)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return added, skipped, fmt.Errorf("reconcile images: %w", err)
+		}
+		_, err = service.Image(galleryID, filename)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return added, skipped, fmt.Errorf("reconcile images: %w", err)
+		}
+		img := Image{
+			GalleryID: galleryID,
+			UserID:    gallery.UserID,
+			Filename:  filename,
+			Key:       object.Key,
+			CreatedAt: object.ModTime,
+		}
+		err = service.readStoredImageInfo(&img)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("skipping %s: %w", object.Key, err))
+			continue
+		}
+		err = service.insertImage(&img)
+		if err != nil {
+			return added, skipped, fmt.Errorf("reconcile images: %w", err)
+		}
+		added++
+	}
+	return added, skipped, nil
+}
+
+func (service *GalleryService) readStoredImageInfo(img *Image) error {
+	contents, _, err := service.store().Get(img.Key)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	rs, ok := contents.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(contents)
+		if err != nil {
+			return err
+		}
+		rs = strings.NewReader(string(b))
+	}
+	return readImageInfo(rs, img)
+}
+
+// parseImageKey splits a key such as "gallery-1/cat.png" into the gallery ID
+// and filename.
+func parseImageKey(key string) (galleryID int, filename string, ok bool) {
+	dir, filename := path.Split(key)
+	idStr, found := strings.CutPrefix(strings.TrimSuffix(dir, "/"), "gallery-")
+	if !found {
+		return 0, "", false
+	}
+	galleryID, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, "", false
+	}
+	return galleryID, filename, true
+}
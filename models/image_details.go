@@ -0,0 +1,141 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+)
+
+const (
+	MaxImageTitleLength   = 200
+	MaxImageCaptionLength = 2000
+	MaxImageAltTextLength = 500
+)
+
+// ImageDetails are the parts of an image that editors write themselves.
+type ImageDetails struct {
+	Title   string
+	Caption string
+	// AltText describes the image to visitors who can't see it.
+	AltText string
+}
+
+// UpdateImageDetails saves the title, caption and alt text of the gallery's
+// image with the filename. ErrNotFound is returned if there is no such image.
+func (service *GalleryService) UpdateImageDetails(galleryID int, filename string, details ImageDetails) error {
+	row := service.DB.QueryRow(`
+		UPDATE images
+		SET title = $3, caption = $4, alt_text = $5
+		WHERE gallery_id = $1 AND filename = $2
+		RETURNING id;`, galleryID, path.Base(filename), details.Title, details.Caption, details.AltText)
+	var id int
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("update image details: %w", err)
+	}
+	return nil
+}
+
+// ReorderImages puts the gallery's images in the order of filenames. Images
+// that are missing from filenames, such as ones uploaded after the order was
+// picked, keep their order after the others. Filenames of images that are not
+// in the gallery, such as ones deleted in the meantime, are skipped.
+func (service *GalleryService) ReorderImages(galleryID int, filenames []string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		SELECT id, filename
+		FROM images
+		WHERE gallery_id = $1
+		ORDER BY position, id
+		FOR UPDATE;`, galleryID)
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	idsByFilename := make(map[string]int)
+	var current []string
+	for rows.Next() {
+		var id int
+		var filename string
+		err := rows.Scan(&id, &filename)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("reorder images: %w", err)
+		}
+		idsByFilename[filename] = id
+		current = append(current, filename)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	var ordered []int
+	placed := make(map[string]bool)
+	for _, filename := range slices.Concat(filenames, current) {
+		id, ok := idsByFilename[filename]
+		if !ok || placed[filename] {
+			continue
+		}
+		placed[filename] = true
+		ordered = append(ordered, id)
+	}
+	for i, id := range ordered {
+		_, err = tx.Exec(`
+			UPDATE images SET position = $2 WHERE id = $1;`, id, i+1)
+		if err != nil {
+			return fmt.Errorf("reorder images: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("reorder images: %w", err)
+	}
+	return nil
+}
+
+// SetCover makes the gallery's image with the filename its cover. An empty
+// filename goes back to using the first image. ErrNotFound is returned if
+// there is no such image.
+func (service *GalleryService) SetCover(galleryID int, filename string) error {
+	var coverImageID sql.NullInt64
+	if filename != "" {
+		image, err := service.Image(galleryID, filename)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return ErrNotFound
+			}
+			return fmt.Errorf("set cover: %w", err)
+		}
+		coverImageID = sql.NullInt64{Int64: int64(image.ID), Valid: true}
+	}
+	_, err := service.DB.Exec(`
+		UPDATE galleries
+		SET cover_image_id = $2
+		WHERE id = $1;`, galleryID, coverImageID)
+	if err != nil {
+		return fmt.Errorf("set cover: %w", err)
+	}
+	return nil
+}
+
+// CoverFrom picks the gallery's cover from its images: the one chosen as its
+// cover, or else the first. It returns nil if there are no images.
+func (gallery Gallery) CoverFrom(images []Image) *Image {
+	if len(images) == 0 {
+		return nil
+	}
+	for i := range images {
+		if images[i].ID == gallery.CoverImageID {
+			return &images[i]
+		}
+	}
+	return &images[0]
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ImageMetadata is what the camera recorded about a photo. Fields the camera
+// didn't record are left empty.
+type ImageMetadata struct {
+	CameraMake  string
+	CameraModel string
+	LensModel   string
+	// ExposureTime is in seconds.
+	ExposureTime float64
+	FNumber      float64
+	// FocalLength is in millimeters.
+	FocalLength float64
+	ISO         int
+	// CapturedAt is when the photo was taken, by the camera's clock. Unless
+	// the camera recorded its UTC offset, the time zone is unknown and the
+	// time is given in UTC.
+	CapturedAt time.Time
+	// Location is where the photo was taken, or nil if it wasn't recorded.
+	Location *GeoLocation
+}
+
+// GeoLocation is a point on Earth in decimal degrees.
+type GeoLocation struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Empty reports whether nothing about the photo was recorded.
+func (m ImageMetadata) Empty() bool {
+	return m == ImageMetadata{}
+}
+
+// readMetadata returns the metadata in the image contents, leaving contents
+// positioned at the start. Images without metadata, or with metadata that
+// can't be read, get empty metadata; that is no reason to turn away an
+// upload.
+func readMetadata(contents io.ReadSeeker, contentType string) (ImageMetadata, error) {
+	var meta ImageMetadata
+	data, err := readExif(contents, contentType)
+	if err == nil {
+		parsed, err := parseExif(data)
+		if err == nil {
+			meta = *parsed
+		}
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return ImageMetadata{}, fmt.Errorf("read metadata: %w", err)
+	}
+	return meta, nil
+}
+
+// saveMetadata stores the metadata of the image, replacing any it had.
+func (service *GalleryService) saveMetadata(imageID int, meta ImageMetadata) error {
+	if meta.Empty() {
+		_, err := service.DB.Exec(`
+			DELETE FROM image_metadata WHERE image_id = $1;`, imageID)
+		if err != nil {
+			return fmt.Errorf("save metadata: %w", err)
+		}
+		return nil
+	}
+	var capturedAt sql.NullTime
+	if !meta.CapturedAt.IsZero() {
+		capturedAt = sql.NullTime{Time: meta.CapturedAt, Valid: true}
+	}
+	var latitude, longitude sql.NullFloat64
+	if meta.Location != nil {
+		latitude = sql.NullFloat64{Float64: meta.Location.Latitude, Valid: true}
+		longitude = sql.NullFloat64{Float64: meta.Location.Longitude, Valid: true}
+	}
+	_, err := service.DB.Exec(`
+		INSERT INTO image_metadata (image_id, camera_make, camera_model, lens_model,
+			exposure_time, f_number, focal_length, iso, captured_at, latitude, longitude)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (image_id) DO
+		UPDATE
+		SET camera_make = $2, camera_model = $3, lens_model = $4,
+			exposure_time = $5, f_number = $6, focal_length = $7, iso = $8,
+			captured_at = $9, latitude = $10, longitude = $11;`,
+		imageID, meta.CameraMake, meta.CameraModel, meta.LensModel,
+		meta.ExposureTime, meta.FNumber, meta.FocalLength, meta.ISO,
+		capturedAt, latitude, longitude)
+	if err != nil {
+		return fmt.Errorf("save metadata: %w", err)
+	}
+	return nil
+}
+
+// Metadata returns the metadata of the gallery's images, by image ID. Images
+// without metadata are left out.
+func (service *GalleryService) Metadata(galleryID int) (map[int]ImageMetadata, error) {
+	rows, err := service.DB.Query(`
+		SELECT image_metadata.image_id, camera_make, camera_model, lens_model,
+			exposure_time, f_number, focal_length, iso, captured_at, latitude, longitude
+		FROM image_metadata
+		JOIN images ON images.id = image_metadata.image_id
+		WHERE images.gallery_id = $1;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query metadata: %w", err)
+	}
+	defer rows.Close()
+	metadata := make(map[int]ImageMetadata)
+	for rows.Next() {
+		var imageID int
+		var meta ImageMetadata
+		var capturedAt sql.NullTime
+		var latitude, longitude sql.NullFloat64
+		err := rows.Scan(&imageID, &meta.CameraMake, &meta.CameraModel, &meta.LensModel,
+			&meta.ExposureTime, &meta.FNumber, &meta.FocalLength, &meta.ISO,
+			&capturedAt, &latitude, &longitude)
+		if err != nil {
+			return nil, fmt.Errorf("query metadata: %w", err)
+		}
+		if capturedAt.Valid {
+			meta.CapturedAt = capturedAt.Time
+		}
+		if latitude.Valid && longitude.Valid {
+			meta.Location = &GeoLocation{Latitude: latitude.Float64, Longitude: longitude.Float64}
+		}
+		metadata[imageID] = meta
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query metadata: %w", err)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,476 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// MetadataPolicy decides which metadata is removed from a gallery's original
+// images before they are served to viewers. Resized variants never have any.
+type MetadataPolicy string
+
+const (
+	// MetadataKeep serves originals exactly as they were uploaded.
+	MetadataKeep MetadataPolicy = "keep"
+	// MetadataStripLocation removes where photos were taken and the serial
+	// numbers of the camera and lens, along with XMP and IPTC, which may
+	// repeat the location.
+	MetadataStripLocation MetadataPolicy = "strip_location"
+	// MetadataStripAll removes EXIF, XMP, IPTC and comments, except for the
+	// orientation, which browsers need to show photos the right way up.
+	MetadataStripAll MetadataPolicy = "strip_all"
+)
+
+// MetadataPolicies lists every metadata policy, in the order they are offered
+// to users.
+var MetadataPolicies = []MetadataPolicy{MetadataKeep, MetadataStripLocation, MetadataStripAll}
+
+// ParseMetadataPolicy returns the metadata policy called s, or an error if
+// there is no such policy.
+func ParseMetadataPolicy(s string) (MetadataPolicy, error) {
+	for _, p := range MetadataPolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("parse metadata policy: unknown policy %q", s)
+}
+
+// The JPEG markers that matter for stripping metadata.
+const (
+	jpegSOS  = 0xda
+	jpegEOI  = 0xd9
+	jpegAPP1 = 0xe1
+	jpegAPP2 = 0xe2
+	// jpegAPP13 holds Photoshop resources, including IPTC.
+	jpegAPP13 = 0xed
+	jpegCOM   = 0xfe
+)
+
+var jpegMPFHeader = []byte("MPF\x00")
+
+// StripMetadata copies the image in r to w, leaving out the metadata the
+// policy calls for. JPEGs and PNGs are filtered without being re-encoded, so
+// the pixels are exactly the same; other images have no metadata that is
+// removed and are copied as is.
+//
+// Nothing is written to w until the start of the image has been read, so if
+// it can't be read at all, the error is returned before anything has been
+// written.
+func StripMetadata(w io.Writer, r io.Reader, contentType string, policy MetadataPolicy) error {
+	var err error
+	switch {
+	case policy == MetadataKeep:
+		_, err = io.Copy(w, r)
+	case contentType == "image/jpeg":
+		err = stripJPEG(w, r, policy)
+	case contentType == "image/png":
+		err = stripPNG(w, r, policy)
+	default:
+		_, err = io.Copy(w, r)
+	}
+	if err != nil {
+		return fmt.Errorf("strip metadata: %w", err)
+	}
+	return nil
+}
+
+// stripJPEG copies a JPEG, leaving out the segments the policy calls for. Only
+// the segments before the image data are changed; the image data itself is
+// copied as is. Anything after the end of the image, such as the extra images
+// phones add for depth maps, is left out too, since it has metadata of its
+// own.
+func stripJPEG(w io.Writer, r io.Reader, policy MetadataPolicy) error {
+	br := bufio.NewReader(r)
+	var header bytes.Buffer
+	err := stripJPEGHeader(&header, br, policy)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write(header.Bytes())
+	err = copyJPEGData(bw, br, policy)
+	// Whatever was copied before an error is still sent, since the response
+	// has already started.
+	flushErr := bw.Flush()
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// stripJPEGHeader copies the segments of the JPEG up to and including the
+// first start of scan segment, leaving out the metadata the policy calls for.
+func stripJPEGHeader(w *bytes.Buffer, br *bufio.Reader, policy MetadataPolicy) error {
+	var soi [2]byte
+	_, err := io.ReadFull(br, soi[:])
+	if err != nil {
+		return err
+	}
+	if soi != [2]byte{0xff, 0xd8} {
+		return fmt.Errorf("not a jpeg")
+	}
+	w.Write(soi[:])
+	for {
+		marker, err := readJPEGMarker(br)
+		if err != nil {
+			return err
+		}
+		if marker == 0x01 {
+			w.Write([]byte{0xff, marker})
+			continue
+		}
+		if marker == jpegEOI || (marker >= 0xd0 && marker <= 0xd7) {
+			return fmt.Errorf("unexpected marker %#x before the image data", marker)
+		}
+		err = copyJPEGSegment(w, br, marker, policy)
+		if err != nil {
+			return err
+		}
+		if marker == jpegSOS {
+			return nil
+		}
+	}
+}
+
+// copyJPEGData copies the image data that follows the first start of scan
+// segment up to the end of the image, along with any segments between scans,
+// which are filtered like the ones before. A JPEG that ends without an end of
+// image marker is given one.
+func copyJPEGData(bw *bufio.Writer, br *bufio.Reader, policy MetadataPolicy) error {
+	for {
+		marker, err := copyJPEGScan(bw, br)
+		if err != nil {
+			return err
+		}
+		if marker == jpegEOI {
+			bw.Write([]byte{0xff, jpegEOI})
+			return nil
+		}
+		err = copyJPEGSegment(bw, br, marker, policy)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyJPEGSegment reads the segment with the given marker and writes it to w,
+// unless the policy leaves it out.
+func copyJPEGSegment(w io.Writer, br *bufio.Reader, marker byte, policy MetadataPolicy) error {
+	var length uint16
+	err := binary.Read(br, binary.BigEndian, &length)
+	if err != nil {
+		return err
+	}
+	if length < 2 {
+		return fmt.Errorf("invalid segment length %d", length)
+	}
+	segment := make([]byte, length-2)
+	_, err = io.ReadFull(br, segment)
+	if err != nil {
+		return err
+	}
+	segment, keep := filterJPEGSegment(marker, segment, policy)
+	if keep {
+		w.Write([]byte{0xff, marker})
+		binary.Write(w, binary.BigEndian, uint16(len(segment)+2))
+		w.Write(segment)
+	}
+	return nil
+}
+
+// filterJPEGSegment returns the segment as it should be served under the
+// policy, and whether it should be served at all.
+func filterJPEGSegment(marker byte, segment []byte, policy MetadataPolicy) ([]byte, bool) {
+	switch {
+	case marker == jpegAPP1 && bytes.HasPrefix(segment, jpegExifHeader):
+		data, keep := filterExif(segment[len(jpegExifHeader):], policy)
+		if !keep {
+			return nil, false
+		}
+		return append(bytes.Clone(jpegExifHeader), data...), true
+	case marker == jpegAPP1:
+		// XMP, which may repeat the EXIF location.
+		return nil, false
+	case marker == jpegAPP2 && bytes.HasPrefix(segment, jpegMPFHeader):
+		// The index of the extra images after the end of the image, which
+		// aren't served.
+		return nil, false
+	case marker == jpegAPP13:
+		// Photoshop resources, whose IPTC has the city and country and whose
+		// copy of the XMP may have the location.
+		return nil, false
+	case marker == jpegCOM:
+		return segment, policy != MetadataStripAll
+	default:
+		return segment, true
+	}
+}
+
+// filterExif returns the EXIF data as it should be served under the policy,
+// and whether it should be served at all.
+func filterExif(data []byte, policy MetadataPolicy) ([]byte, bool) {
+	var err error
+	if policy == MetadataStripAll {
+		data, err = orientationExif(data)
+	} else {
+		data, err = removeExifLocation(data)
+		if err == nil {
+			clearExifSerialNumbers(data)
+		}
+	}
+	// EXIF that can't be read can't be cleaned either.
+	if err != nil || data == nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// copyJPEGScan copies the image data following a start of scan segment, up to
+// the next marker, which it returns. If the file ends first, the image is
+// taken to end there too, and jpegEOI is returned.
+func copyJPEGScan(bw *bufio.Writer, br *bufio.Reader) (byte, error) {
+	for {
+		chunk, err := br.ReadSlice(0xff)
+		if err == bufio.ErrBufferFull {
+			bw.Write(chunk)
+			continue
+		}
+		if err == io.EOF {
+			bw.Write(chunk)
+			return jpegEOI, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		// The chunk is only valid until the next read.
+		bw.Write(chunk[:len(chunk)-1])
+		b, err := br.ReadByte()
+		for err == nil && b == 0xff {
+			b, err = br.ReadByte()
+		}
+		if err == io.EOF {
+			return jpegEOI, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		// A 0xff in the image data is followed by 0 to tell it apart from
+		// a marker. Restart markers are part of the image data too.
+		if b == 0x00 || (b >= 0xd0 && b <= 0xd7) {
+			bw.Write([]byte{0xff, b})
+			continue
+		}
+		return b, nil
+	}
+}
+
+// removeExifLocation returns a copy of the EXIF data without the GPS IFD. Its
+// entries and values are zeroed and the pointer to it is removed from IFD0;
+// everything else stays where it was.
+func removeExifLocation(data []byte) ([]byte, error) {
+	data = bytes.Clone(data)
+	t, ifd0Offset, err := newTIFF(data)
+	if err != nil {
+		return nil, fmt.Errorf("remove exif location: %w", err)
+	}
+	ifd0, err := t.ifd(ifd0Offset)
+	if err != nil {
+		return nil, fmt.Errorf("remove exif location: %w", err)
+	}
+	entry, ok := ifd0[tagGPSIFD]
+	if !ok {
+		return data, nil
+	}
+	gpsOffset := t.uint(entry)
+	gps, err := t.ifd(gpsOffset)
+	if err == nil {
+		for _, entry := range gps {
+			clear(entry.value)
+		}
+		n := uint64(t.order.Uint16(data[gpsOffset:]))
+		clear(data[gpsOffset : uint64(gpsOffset)+2+n*12])
+	}
+	// Move the entries after the GPS pointer, and the offset of the next IFD,
+	// up over it.
+	n := uint64(t.order.Uint16(data[ifd0Offset:]))
+	start := uint64(ifd0Offset) + 2
+	end := min(start+n*12+4, uint64(len(data)))
+	for i := uint64(0); i < n; i++ {
+		e := start + i*12
+		if t.order.Uint16(data[e:]) != tagGPSIFD {
+			continue
+		}
+		copy(data[e:end], data[e+12:end])
+		clear(data[end-12 : end])
+		t.order.PutUint16(data[ifd0Offset:], uint16(n-1))
+		break
+	}
+	return data, nil
+}
+
+// The EXIF tags that identify the camera or lens the photo was taken with.
+// Maker notes are the camera maker's own data, which usually includes the
+// serial number too.
+var exifSerialNumberTags = []uint16{tagBodySerialNumber, tagLensSerialNumber, tagMakerNote}
+
+// clearExifSerialNumbers zeroes the values of the serial number tags in EXIF
+// data, in place. EXIF that can't be read is left as it is.
+func clearExifSerialNumbers(data []byte) {
+	t, ifd0Offset, err := newTIFF(data)
+	if err != nil {
+		return
+	}
+	ifd0, err := t.ifd(ifd0Offset)
+	if err != nil {
+		return
+	}
+	clear(ifd0[tagCameraSerialNumber].value)
+	entry, ok := ifd0[tagExifIFD]
+	if !ok {
+		return
+	}
+	exif, err := t.ifd(t.uint(entry))
+	if err != nil {
+		return
+	}
+	for _, tag := range exifSerialNumberTags {
+		clear(exif[tag].value)
+	}
+}
+
+// orientationExif returns EXIF data with nothing but the orientation of the
+// photo, or nil if it doesn't need turning.
+func orientationExif(data []byte) ([]byte, error) {
+	t, ifd0Offset, err := newTIFF(data)
+	if err != nil {
+		return nil, fmt.Errorf("orientation exif: %w", err)
+	}
+	ifd0, err := t.ifd(ifd0Offset)
+	if err != nil {
+		return nil, fmt.Errorf("orientation exif: %w", err)
+	}
+	orientation := t.uint(ifd0[tagOrientation])
+	if orientation < 2 || orientation > 8 {
+		return nil, nil
+	}
+	// The header, then an IFD with a single entry and no next IFD.
+	out := make([]byte, 8+2+12+4)
+	copy(out, data[:4])
+	t.order.PutUint32(out[4:], 8)
+	t.order.PutUint16(out[8:], 1)
+	t.order.PutUint16(out[10:], tagOrientation)
+	t.order.PutUint16(out[12:], tiffShort)
+	t.order.PutUint32(out[14:], 1)
+	t.order.PutUint16(out[18:], uint16(orientation))
+	return out, nil
+}
+
+// pngMetadataChunks are the PNG chunks that may hold metadata the policies
+// remove. Every other chunk, including the image data, is copied as is.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+}
+
+// stripPNG copies a PNG chunk by chunk, leaving out the metadata the policy
+// calls for. Chunks after the end of the image are left out too.
+func stripPNG(w io.Writer, r io.Reader, policy MetadataPolicy) error {
+	br := bufio.NewReader(r)
+	var signature [8]byte
+	_, err := io.ReadFull(br, signature[:])
+	if err != nil {
+		return err
+	}
+	if string(signature[:]) != pngSignature {
+		return fmt.Errorf("not a png")
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write(signature[:])
+	err = copyPNGChunks(bw, br, policy)
+	// Whatever was copied before an error is still sent, since the response
+	// has already started.
+	flushErr := bw.Flush()
+	if err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// copyPNGChunks copies the chunks that follow the signature up to and
+// including the end of the image.
+func copyPNGChunks(bw *bufio.Writer, br *bufio.Reader, policy MetadataPolicy) error {
+	for {
+		var header [8]byte
+		_, err := io.ReadFull(br, header[:])
+		if err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:])
+		switch {
+		case !pngMetadataChunks[chunkType]:
+			// Copy the chunk's data and CRC.
+			bw.Write(header[:])
+			_, err = io.CopyN(bw, br, int64(length)+4)
+		case length > maxExifSize:
+			// Too large to be worth reading, so it is left out unseen.
+			_, err = br.Discard(int(length) + 4)
+		default:
+			chunk := make([]byte, length+4)
+			_, err = io.ReadFull(br, chunk)
+			if err != nil {
+				return err
+			}
+			data, keep := filterPNGChunk(chunkType, chunk[:length], policy)
+			if keep {
+				writePNGChunk(bw, chunkType, data)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
+
+// filterPNGChunk returns the data of a metadata chunk as it should be served
+// under the policy, and whether it should be served at all.
+func filterPNGChunk(chunkType string, data []byte, policy MetadataPolicy) ([]byte, bool) {
+	if chunkType == "eXIf" {
+		return filterExif(bytes.Clone(data), policy)
+	}
+	// Text chunks start with a keyword naming what they hold.
+	keyword, _, _ := bytes.Cut(data, []byte{0})
+	switch {
+	case string(keyword) == "XML:com.adobe.xmp":
+		// XMP, which may repeat the EXIF location.
+		return nil, false
+	case bytes.HasPrefix(keyword, []byte("Raw profile type ")):
+		// The EXIF, IPTC or XMP that ImageMagick keeps in text chunks.
+		return nil, false
+	default:
+		// Comments, like the JPEG ones.
+		return data, policy != MetadataStripAll
+	}
+}
+
+// writePNGChunk writes a chunk with the given type and data, along with its
+// CRC, which covers both.
+func writePNGChunk(w io.Writer, chunkType string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	io.WriteString(crc, chunkType)
+	crc.Write(data)
+	io.WriteString(w, chunkType)
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// ImageStore is the storage backend the GalleryService uses to persist image
+// files. Keys are slash separated paths such as "gallery-1/cat.png".
+//
+// Implementations should return an error wrapping fs.ErrNotExist when a key
+// does not exist so that callers can check for it with errors.Is.
+type ImageStore interface {
+	Put(key string, contents io.Reader) error
+	Get(key string) (io.ReadCloser, ObjectInfo, error)
+	List(prefix string) ([]ObjectInfo, error)
+	Delete(key string) error
+	Stat(key string) (ObjectInfo, error)
+}
+
+// ObjectInfo describes a single object held by an ImageStore.
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+}
+
+const (
+	ImageStoreLocal = "local"
+	ImageStoreS3    = "s3"
+)
+
+type ImageStoreConfig struct {
+	// Backend is either ImageStoreLocal or ImageStoreS3. Defaults to
+	// ImageStoreLocal.
+	Backend string
+	// Dir is the root directory used by the local backend.
+	Dir string
+	S3  S3Config
+}
+
+func DefaultImageStoreConfig() (ImageStoreConfig, error) {
+	var cfg ImageStoreConfig
+	err := godotenv.Load()
+	if err != nil {
+		return cfg, err
+	}
+	return ImageStoreConfig{
+		Backend: os.Getenv("IMAGES_BACKEND"),
+		Dir:     os.Getenv("IMAGES_DIR"),
+		S3: S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PathStyle: os.Getenv("S3_PATH_STYLE") == "true",
+		},
+	}, nil
+}
+
+// NewImageStore builds the ImageStore described by the config.
+func NewImageStore(cfg ImageStoreConfig) (ImageStore, error) {
+	switch cfg.Backend {
+	case "", ImageStoreLocal:
+		return &LocalImageStore{Dir: cfg.Dir}, nil
+	case ImageStoreS3:
+		if cfg.S3.Endpoint == "" || cfg.S3.Bucket == "" {
+			return nil, fmt.Errorf("new image store: s3 endpoint and bucket are required")
+		}
+		return &S3ImageStore{S3Config: cfg.S3}, nil
+	default:
+		return nil, fmt.Errorf("new image store: unknown backend %q", cfg.Backend)
+	}
+}
+
+// LocalImageStore stores images on the local filesystem. Keys map directly to
+// paths below Dir, so "gallery-1/cat.png" is stored at "images/gallery-1/cat.png"
+// when Dir is "images".
+type LocalImageStore struct {
+	// Dir is the root directory for all images. If not set, the "images"
+	// directory is used.
+	Dir string
+}
+
+func (ls *LocalImageStore) Put(key string, contents io.Reader) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	dst, err := os.Create(p)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, contents)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	return nil
+}
+
+// Get returns the file for the key. The returned io.ReadCloser is an *os.File,
+// so it also implements io.Seeker.
+func (ls *LocalImageStore) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get: %w", err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get: %w", err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, fmt.Errorf("get: %w", err)
+	}
+	return f, ls.objectInfo(key, stat), nil
+}
+
+func (ls *LocalImageStore) List(prefix string) ([]ObjectInfo, error) {
+	root := ls.root()
+	var objects []ObjectInfo
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && p == root {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ls.objectInfo(key, stat))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list: %w", err)
+	}
+	return objects, nil
+}
+
+// Delete removes the file for the key along with any parent directories that
+// are left empty, so deleting the last image of a gallery also removes the
+// gallery directory.
+func (ls *LocalImageStore) Delete(key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	err = os.Remove(p)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	root := filepath.Clean(ls.root())
+	for dir := filepath.Dir(p); dir != root && dir != "."; dir = filepath.Dir(dir) {
+		// os.Remove refuses to delete non-empty directories, which is exactly
+		// where we want to stop.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (ls *LocalImageStore) Stat(key string) (ObjectInfo, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	stat, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	return ls.objectInfo(key, stat), nil
+}
+
+func (ls *LocalImageStore) root() string {
+	if ls.Dir == "" {
+		return "images"
+	}
+	return ls.Dir
+}
+
+// path converts a key into a filesystem path, refusing keys that would escape
+// the root directory.
+func (ls *LocalImageStore) path(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != key {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(ls.root(), filepath.FromSlash(cleaned)), nil
+}
+
+func (ls *LocalImageStore) objectInfo(key string, stat fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:         key,
+		Size:        stat.Size(),
+		ModTime:     stat.ModTime(),
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	}
+}
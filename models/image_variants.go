@@ -0,0 +1,195 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// JobGenerateVariants is the kind of job enqueued by CreateImage when the
+	// GalleryService has a JobService.
+	JobGenerateVariants = "generate_image_variants"
+)
+
+const (
+	ImageSizeThumb  = "thumb"
+	ImageSizeMedium = "medium"
+	ImageSizeLarge  = "large"
+)
+
+// imageSizes lists the variants generated for every image from largest to
+// smallest. Each variant fits within a square of max pixels and keeps the
+// aspect ratio of the original.
+var imageSizes = []struct {
+	name string
+	max  int
+}{
+	{ImageSizeLarge, 2048},
+	{ImageSizeMedium, 1024},
+	{ImageSizeThumb, 320},
+}
+
+// ImageVariant is a resized copy of an image.
+type ImageVariant struct {
+	Size   string
+	Width  int
+	Height int
+}
+
+// Variants returns the resized copies that exist for the image, from smallest
+// to largest. Images are never scaled up, so an image that already fits within
+// a size has no variant for it.
+func (img Image) Variants() []ImageVariant {
+	var variants []ImageVariant
+	for i := len(imageSizes) - 1; i >= 0; i-- {
+		size := imageSizes[i]
+		width, height, ok := fitWithin(img.Width, img.Height, size.max)
+		if !ok {
+			continue
+		}
+		variants = append(variants, ImageVariant{
+			Size:   size.name,
+			Width:  width,
+			Height: height,
+		})
+	}
+	return variants
+}
+
+// IsImageSize reports whether size names one of the generated variants.
+func IsImageSize(size string) bool {
+	for _, s := range imageSizes {
+		if s.name == size {
+			return true
+		}
+	}
+	return false
+}
+
+// fitWithin returns the dimensions of a width x height image scaled down to
+// fit within bound x bound. ok is false if the image already fits.
+func fitWithin(width, height, bound int) (int, int, bool) {
+	if width <= bound && height <= bound {
+		return width, height, false
+	}
+	if width >= height {
+		return bound, (height*bound + width/2) / width, true
+	}
+	return (width*bound + height/2) / height, bound, true
+}
+
+func (service *GalleryService) variantKey(img Image, size string) string {
+	return service.galleryPrefix(img.GalleryID) + size + "/" + img.Filename
+}
+
+// GenerateVariants reads the original image from the image store and writes a
+// resized copy for each image size. Variants that are not needed for the
+// image, because it is already small enough, are removed so that a replaced
+// image never leaves a stale variant behind.
+func (service *GalleryService) GenerateVariants(img Image) error {
+	contents, _, err := service.store().Get(img.Key)
+	if err != nil {
+		return fmt.Errorf("generate variants: %w", err)
+	}
+	defer contents.Close()
+	err = service.createVariants(img, contents)
+	if err != nil {
+		return fmt.Errorf("generate variants: %w", err)
+	}
+	return nil
+}
+
+type generateVariantsJob struct {
+	GalleryID int
+	Filename  string
+}
+
+// GenerateVariantsJob is the JobHandler for JobGenerateVariants jobs. Images
+// deleted before the job runs are skipped.
+func (service *GalleryService) GenerateVariantsJob(payload json.RawMessage) error {
+	var job generateVariantsJob
+	err := json.Unmarshal(payload, &job)
+	if err != nil {
+		return fmt.Errorf("generate variants job: %w", err)
+	}
+	img, err := service.Image(job.GalleryID, job.Filename)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return fmt.Errorf("generate variants job: %w", err)
+	}
+	return service.GenerateVariants(img)
+}
+
+func (service *GalleryService) createVariants(img Image, contents io.Reader) error {
+	// Images are checked for size when they are uploaded, but ones stored
+	// before there was a limit may not have been.
+	src, format, err := decodeImage(contents)
+	if err != nil {
+		return err
+	}
+	bounds := src.Bounds()
+	// Each variant is scaled down from the previous, larger one, which is much
+	// faster than scaling every variant from a large original.
+	for _, size := range imageSizes {
+		key := service.variantKey(img, size.name)
+		width, height, ok := fitWithin(bounds.Dx(), bounds.Dy(), size.max)
+		if !ok {
+			err := service.store().Delete(key)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("deleting %s variant: %w", size.name, err)
+			}
+			continue
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+		var buf bytes.Buffer
+		err = encodeImage(&buf, dst, format)
+		if err != nil {
+			return fmt.Errorf("encoding %s variant: %w", size.name, err)
+		}
+		err = service.store().Put(key, &buf)
+		if err != nil {
+			return fmt.Errorf("storing %s variant: %w", size.name, err)
+		}
+		src = dst
+	}
+	return nil
+}
+
+func (service *GalleryService) deleteVariants(img Image) error {
+	for _, size := range imageSizes {
+		err := service.store().Delete(service.variantKey(img, size.name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("deleting %s variant: %w", size.name, err)
+		}
+	}
+	return nil
+}
+
+// encodeImage writes img in the same format as the original so that variants
+// keep the original's file extension. Animated GIFs only keep their first
+// frame.
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+}
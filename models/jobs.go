@@ -0,0 +1,291 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+	// JobDead is the status of a job that failed MaxAttempts times. Dead jobs
+	// are kept for inspection until they are swept, and are never retried
+	// automatically.
+	JobDead = "dead"
+)
+
+const (
+	// DefaultJobMaxAttempts is the number of times a job is tried before it
+	// is marked as dead.
+	DefaultJobMaxAttempts = 5
+	// DefaultJobBackoff is the delay before the first retry of a failed job.
+	// Each further retry waits twice as long, up to MaxJobBackoff.
+	DefaultJobBackoff = 10 * time.Second
+	MaxJobBackoff     = 1 * time.Hour
+
+	// DefaultJobDoneRetention is how long finished jobs are kept.
+	DefaultJobDoneRetention = 7 * 24 * time.Hour
+	// DefaultJobDeadRetention is how long dead jobs are kept for inspection.
+	DefaultJobDeadRetention = 30 * 24 * time.Hour
+)
+
+type Job struct {
+	ID          int
+	Kind        string
+	Payload     json.RawMessage
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+	RunAt       time.Time
+	CreatedAt   time.Time
+}
+
+// JobHandler performs a job. The payload is the JSON passed to Enqueue.
+// Returning an error schedules the job to be retried.
+type JobHandler func(payload json.RawMessage) error
+
+type JobService struct {
+	DB *sql.DB
+
+	// MaxAttempts defaults to DefaultJobMaxAttempts.
+	MaxAttempts int
+	// Backoff defaults to DefaultJobBackoff.
+	Backoff time.Duration
+	// DoneRetention defaults to DefaultJobDoneRetention.
+	DoneRetention time.Duration
+	// DeadRetention defaults to DefaultJobDeadRetention.
+	DeadRetention time.Duration
+}
+
+// Enqueue stores a job to be run as soon as a worker is free. payload is
+// encoded as JSON.
+func (js *JobService) Enqueue(kind string, payload any) (*Job, error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("enqueue %s: %w", kind, err)
+	}
+	maxAttempts := js.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultJobMaxAttempts
+	}
+	job := Job{
+		Kind:        kind,
+		Payload:     payloadJSON,
+		Status:      JobPending,
+		MaxAttempts: maxAttempts,
+	}
+	row := js.DB.QueryRow(`
+		INSERT INTO jobs (kind, payload, max_attempts)
+		VALUES ($1, $2, $3)
+		RETURNING id, run_at, created_at;`, job.Kind, []byte(job.Payload), job.MaxAttempts)
+	err = row.Scan(&job.ID, &job.RunAt, &job.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("enqueue %s: %w", kind, err)
+	}
+	return &job, nil
+}
+
+// runNext claims the next pending job that is due and runs it with the
+// matching handler. The job row stays locked for the duration of the handler
+// so that if the process dies, the transaction is rolled back and another
+// worker picks the job up. ran is false when no job was available.
+func (js *JobService) runNext(handlers map[string]JobHandler) (ran bool, err error) {
+	tx, err := js.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("run next job: %w", err)
+	}
+	defer tx.Rollback()
+
+	var job Job
+	var payload []byte
+	row := tx.QueryRow(`
+		SELECT id, kind, payload, attempts, max_attempts
+		FROM jobs
+		WHERE status = $1 AND run_at <= NOW()
+		ORDER BY run_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED;`, JobPending)
+	err = row.Scan(&job.ID, &job.Kind, &payload, &job.Attempts, &job.MaxAttempts)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("run next job: %w", err)
+	}
+	job.Payload = payload
+	job.Attempts++
+
+	jobErr := runJob(handlers, job)
+	switch {
+	case jobErr == nil:
+		_, err = tx.Exec(`
+			UPDATE jobs
+			SET status = $2, attempts = $3, last_error = '', updated_at = NOW()
+			WHERE id = $1;`, job.ID, JobDone, job.Attempts)
+	case job.Attempts >= job.MaxAttempts:
+		log.Printf("job %d (%s) is dead after %d attempts: %v", job.ID, job.Kind, job.Attempts, jobErr)
+		_, err = tx.Exec(`
+			UPDATE jobs
+			SET status = $2, attempts = $3, last_error = $4, updated_at = NOW()
+			WHERE id = $1;`, job.ID, JobDead, job.Attempts, jobErr.Error())
+	default:
+		log.Printf("job %d (%s) failed on attempt %d: %v", job.ID, job.Kind, job.Attempts, jobErr)
+		_, err = tx.Exec(`
+			UPDATE jobs
+			SET attempts = $2, last_error = $3, run_at = $4, updated_at = NOW()
+			WHERE id = $1;`, job.ID, job.Attempts, jobErr.Error(), time.Now().Add(js.backoff(job.Attempts)))
+	}
+	if err != nil {
+		return true, fmt.Errorf("run next job: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return true, fmt.Errorf("run next job: %w", err)
+	}
+	return true, nil
+}
+
+// backoff returns how long to wait before retrying a job that has failed the
+// given number of times.
+func (js *JobService) backoff(attempts int) time.Duration {
+	backoff := js.Backoff
+	if backoff <= 0 {
+		backoff = DefaultJobBackoff
+	}
+	for i := 1; i < attempts && backoff < MaxJobBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > MaxJobBackoff {
+		backoff = MaxJobBackoff
+	}
+	return backoff
+}
+
+// DeleteOld deletes done and dead jobs that finished longer ago than their
+// retention periods, and returns how many were deleted.
+func (js *JobService) DeleteOld() (int64, error) {
+	doneRetention := js.DoneRetention
+	if doneRetention <= 0 {
+		doneRetention = DefaultJobDoneRetention
+	}
+	deadRetention := js.DeadRetention
+	if deadRetention <= 0 {
+		deadRetention = DefaultJobDeadRetention
+	}
+	now := time.Now()
+	result, err := js.DB.Exec(`
+		DELETE FROM jobs
+		WHERE (status = $1 AND updated_at < $2)
+			OR (status = $3 AND updated_at < $4);`,
+		JobDone, now.Add(-doneRetention), JobDead, now.Add(-deadRetention))
+	if err != nil {
+		return 0, fmt.Errorf("delete old jobs: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete old jobs: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep calls DeleteOld every interval until the context is cancelled.
+func (js *JobService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := js.DeleteOld()
+		if err != nil {
+			log.Printf("sweeping jobs: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d old jobs", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runJob(handlers map[string]JobHandler, job Job) (err error) {
+	handler, ok := handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("no handler for job kind %q", job.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(job.Payload)
+}
+
+// Worker runs jobs from a JobService.
+type Worker struct {
+	JobService *JobService
+	// Concurrency is the number of jobs run at the same time. Defaults to 1.
+	Concurrency int
+	// PollInterval is how long an idle worker waits before checking for new
+	// jobs. Defaults to 1 second.
+	PollInterval time.Duration
+
+	handlers map[string]JobHandler
+}
+
+// Handle registers the handler for jobs of the given kind. It must be called
+// before Run.
+func (w *Worker) Handle(kind string, handler JobHandler) {
+	if w.handlers == nil {
+		w.handlers = make(map[string]JobHandler)
+	}
+	w.handlers[kind] = handler
+}
+
+// Run processes jobs until the context is cancelled. Jobs that are running
+// when that happens are finished before Run returns. Old jobs are swept every
+// hour while it runs.
+func (w *Worker) Run(ctx context.Context) {
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	pollInterval := w.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.JobService.Sweep(ctx, time.Hour)
+	}()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				ran, err := w.JobService.runNext(w.handlers)
+				if err != nil {
+					log.Println(err)
+				}
+				wait := time.Duration(0)
+				if !ran || err != nil {
+					wait = pollInterval
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -52,31 +52,47 @@ func (mt MailTrap) Dial(email *Email) (*http.Request, error) {
 }
 
 func (mt MailTrap) Send(emailRequest *http.Request) error {
+	_, err := mt.send(emailRequest)
+	return err
+}
+
+// send makes the request and returns the body of MailTrap's response, which
+// includes the IDs of the messages it accepted.
+func (mt MailTrap) send(emailRequest *http.Request) (string, error) {
 	client := http.DefaultClient
 	res, err := client.Do(emailRequest)
 	if err != nil {
-		return fmt.Errorf("send: %w", err)
+		return "", fmt.Errorf("send: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("send: %w", err)
 	}
 	ok := res.StatusCode >= 200 && res.StatusCode < 300
 	if !ok {
-		body, err := io.ReadAll(res.Body)
-		defer res.Body.Close()
-		if err != nil {
-			return fmt.Errorf("send: %w", err)
-		}
-		return fmt.Errorf("send: HTTP %d: %s", res.StatusCode, string(body))
+		return "", fmt.Errorf("send: HTTP %d: %s", res.StatusCode, string(body))
 	}
-	return nil
+	return string(body), nil
 }
 
 func (mt MailTrap) DialAndSend(email *Email) error {
-	emailRequest, err := mt.Dial(email)
+	_, err := mt.Deliver(email)
 	if err != nil {
 		return fmt.Errorf("dialandsend: %w", err)
 	}
-	err = mt.Send(emailRequest)
+	return nil
+}
+
+// Deliver sends the email and returns MailTrap's response.
+func (mt MailTrap) Deliver(email *Email) (string, error) {
+	emailRequest, err := mt.Dial(email)
+	if err != nil {
+		return "", fmt.Errorf("deliver: %w", err)
+	}
+	response, err := mt.send(emailRequest)
 	if err != nil {
-		return fmt.Errorf("dialandsend: %w", err)
+		return "", fmt.Errorf("deliver: %w", err)
 	}
-	return nil
+	return response, nil
 }
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrTokenExpired = errors.New("models: token has expired")
+	ErrTokenInvalid = errors.New("models: invalid token")
+)
+
+// TokenPurpose is what a OneTimeToken was issued for. A token can only be
+// consumed for the purpose it was issued for, so a password reset link can
+// never be used to sign in and vice versa.
+type TokenPurpose string
+
+const (
+	PurposePasswordReset TokenPurpose = "reset"
+	PurposeMagicLink     TokenPurpose = "magic-link"
+	PurposeEmailVerify   TokenPurpose = "email-verify"
+	// PurposeTwoFactor tokens link the second step of signing in to a user
+	// who already entered their password.
+	PurposeTwoFactor TokenPurpose = "two-factor"
+)
+
+// DefaultTokenDuration returns the default time that a OneTimeToken issued for
+// the purpose is valid for.
+func DefaultTokenDuration(purpose TokenPurpose) time.Duration {
+	switch purpose {
+	case PurposeMagicLink:
+		return 15 * time.Minute
+	case PurposeTwoFactor:
+		return 5 * time.Minute
+	case PurposeEmailVerify:
+		return 24 * time.Hour
+	default:
+		return 1 * time.Hour
+	}
+}
+
+type OneTimeToken struct {
+	ID int
+	// UserID is 0 for tokens that are not tied to an account.
+	UserID  int
+	Purpose TokenPurpose
+	// Data holds purpose specific information, such as the email address that
+	// is being verified.
+	Data string
+	// Token is only set when a OneTimeToken is being created bc only TokenHash
+	// is stored in DB.
+	Token     string
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+type OneTimeTokenService struct {
+	DB           *sql.DB
+	TokenManager *TokenManager
+
+	// Durations overrides how long tokens are valid for per purpose. Purposes
+	// that are missing use DefaultTokenDuration.
+	Durations map[TokenPurpose]time.Duration
+}
+
+// Create issues a new token for the purpose. Tokens for a user replace any
+// earlier token the user had for the same purpose, so only the most recent
+// link that was emailed works.
+func (service *OneTimeTokenService) Create(userID int, purpose TokenPurpose, data string) (*OneTimeToken, error) {
+	token, tokenHash, err := service.tokenManager().New()
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	ott := OneTimeToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		Data:      data,
+		Token:     token,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(service.duration(purpose)),
+	}
+	var nullUserID sql.NullInt64
+	if userID != 0 {
+		nullUserID = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	defer tx.Rollback()
+	if userID != 0 {
+		_, err = tx.Exec(`
+			DELETE FROM one_time_tokens
+			WHERE user_id = $1 AND purpose = $2;`, userID, purpose)
+		if err != nil {
+			return nil, fmt.Errorf("create: %w", err)
+		}
+	}
+	row := tx.QueryRow(`
+		INSERT INTO one_time_tokens (user_id, purpose, data, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at;`, nullUserID, ott.Purpose, ott.Data, ott.TokenHash, ott.ExpiresAt)
+	err = row.Scan(&ott.ID, &ott.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	return &ott, nil
+}
+
+// Consume looks up the token and deletes it so that it cannot be used again.
+// ErrTokenInvalid is returned if the token doesn't exist or was issued for a
+// different purpose, in which case it is left untouched.
+func (service *OneTimeTokenService) Consume(token string, purpose TokenPurpose) (*OneTimeToken, error) {
+	ott := OneTimeToken{
+		Purpose:   purpose,
+		TokenHash: service.tokenManager().Hash(token),
+	}
+	var userID sql.NullInt64
+	row := service.DB.QueryRow(`
+		DELETE FROM one_time_tokens
+		WHERE token_hash = $1 AND purpose = $2
+		RETURNING id, user_id, data, created_at, expires_at;`, ott.TokenHash, purpose)
+	err := row.Scan(&ott.ID, &userID, &ott.Data, &ott.CreatedAt, &ott.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTokenInvalid
+		}
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	ott.UserID = int(userID.Int64)
+	if time.Now().After(ott.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return &ott, nil
+}
+
+// Pending returns the user's unexpired token for the purpose, or ErrNotFound
+// if there is none. The Token field is never set.
+func (service *OneTimeTokenService) Pending(userID int, purpose TokenPurpose) (*OneTimeToken, error) {
+	ott := OneTimeToken{
+		UserID:  userID,
+		Purpose: purpose,
+	}
+	row := service.DB.QueryRow(`
+		SELECT id, data, token_hash, created_at, expires_at
+		FROM one_time_tokens
+		WHERE user_id = $1 AND purpose = $2 AND expires_at > NOW()
+		ORDER BY created_at DESC
+		LIMIT 1;`, userID, purpose)
+	err := row.Scan(&ott.ID, &ott.Data, &ott.TokenHash, &ott.CreatedAt, &ott.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("pending: %w", err)
+	}
+	return &ott, nil
+}
+
+// DeleteExpired removes every expired token and returns how many were removed.
+func (service *OneTimeTokenService) DeleteExpired() (int64, error) {
+	res, err := service.DB.Exec(`
+		DELETE FROM one_time_tokens
+		WHERE expires_at <= NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep calls DeleteExpired every interval until the context is cancelled.
+func (service *OneTimeTokenService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := service.DeleteExpired()
+		if err != nil {
+			log.Printf("sweeping tokens: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d expired tokens", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (service *OneTimeTokenService) tokenManager() *TokenManager {
+	if service.TokenManager == nil {
+		return &TokenManager{}
+	}
+	return service.TokenManager
+}
+
+func (service *OneTimeTokenService) duration(purpose TokenPurpose) time.Duration {
+	if d, ok := service.Durations[purpose]; ok {
+		return d
+	}
+	return DefaultTokenDuration(purpose)
+}
@@ -0,0 +1,267 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"golang.org/x/image/draw"
+)
+
+var (
+	ErrSlugTaken   = errors.New("models: slug is already in use")
+	ErrInvalidSlug = errors.New("models: invalid slug")
+)
+
+const (
+	MinSlugLength        = 3
+	MaxSlugLength        = 30
+	MaxDisplayNameLength = 100
+	MaxBioLength         = 1000
+
+	// AvatarSize is the width and height that avatars are cropped and scaled
+	// to.
+	AvatarSize = 256
+)
+
+// slugPattern allows lowercase letters and digits, with single dashes between
+// them.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// NormalizeSlug turns what a user typed into the slug it stands for, so that
+// "Jane-Doe " and "jane-doe" are the same slug.
+func NormalizeSlug(slug string) string {
+	return strings.ToLower(strings.TrimSpace(slug))
+}
+
+// ValidSlug reports whether the normalized slug can be used as a username.
+func ValidSlug(slug string) bool {
+	return len(slug) >= MinSlugLength && len(slug) <= MaxSlugLength && slugPattern.MatchString(slug)
+}
+
+// Profile is the part of a user that is shown on their public profile page.
+type Profile struct {
+	// Slug is empty to take the profile down.
+	Slug        string
+	DisplayName string
+	Bio         string
+}
+
+// BySlug returns the user whose profile is at the slug. Users who changed
+// their slug are also found by their old ones; callers can compare the slug
+// to the returned user's Slug to redirect to the current one.
+func (us *UserService) BySlug(slug string) (*User, error) {
+	slug = NormalizeSlug(slug)
+	var id int
+	row := us.DB.QueryRow(`
+		SELECT id FROM users WHERE slug = $1
+		UNION ALL
+		SELECT user_id FROM user_slug_redirects WHERE slug = $1
+		LIMIT 1;`, slug)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by slug: %w", err)
+	}
+	user, err := us.ByID(id)
+	if err != nil {
+		return nil, fmt.Errorf("query user by slug: %w", err)
+	}
+	if user.Slug == "" {
+		// The user took their profile down.
+		return nil, ErrNotFound
+	}
+	return user, nil
+}
+
+// UpdateProfile saves the user's profile. When the slug changes, the old one
+// keeps redirecting to the user and can't be taken by anyone else.
+// ErrInvalidSlug is returned for slugs that ValidSlug rejects and
+// ErrSlugTaken for slugs that belong, or used to belong, to another user.
+func (us *UserService) UpdateProfile(userID int, profile Profile) error {
+	profile.Slug = NormalizeSlug(profile.Slug)
+	if profile.Slug != "" && !ValidSlug(profile.Slug) {
+		return ErrInvalidSlug
+	}
+	tx, err := us.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("update profile: %w", err)
+	}
+	defer tx.Rollback()
+	var oldSlug sql.NullString
+	row := tx.QueryRow(`
+		SELECT slug FROM users WHERE id = $1 FOR UPDATE;`, userID)
+	err = row.Scan(&oldSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("update profile: %w", err)
+	}
+	if profile.Slug != oldSlug.String {
+		err = us.moveSlug(tx, userID, oldSlug.String, profile.Slug)
+		if err != nil {
+			return err
+		}
+	}
+	var slug sql.NullString
+	if profile.Slug != "" {
+		slug = sql.NullString{String: profile.Slug, Valid: true}
+	}
+	_, err = tx.Exec(`
+		UPDATE users
+		SET slug = $2, display_name = $3, bio = $4
+		WHERE id = $1;`, userID, slug, profile.DisplayName, profile.Bio)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) {
+			if pgError.Code == pgerrcode.UniqueViolation {
+				return ErrSlugTaken
+			}
+		}
+		return fmt.Errorf("update profile: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("update profile: %w", err)
+	}
+	return nil
+}
+
+// moveSlug keeps oldSlug as a redirect to the user and releases newSlug if it
+// was one of the user's own old slugs.
+func (us *UserService) moveSlug(tx *sql.Tx, userID int, oldSlug, newSlug string) error {
+	if newSlug != "" {
+		var redirectUserID int
+		row := tx.QueryRow(`
+			SELECT user_id FROM user_slug_redirects WHERE slug = $1;`, newSlug)
+		err := row.Scan(&redirectUserID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("update profile: %w", err)
+		}
+		if err == nil && redirectUserID != userID {
+			return ErrSlugTaken
+		}
+		_, err = tx.Exec(`
+			DELETE FROM user_slug_redirects WHERE slug = $1;`, newSlug)
+		if err != nil {
+			return fmt.Errorf("update profile: %w", err)
+		}
+	}
+	if oldSlug != "" {
+		_, err := tx.Exec(`
+			INSERT INTO user_slug_redirects (slug, user_id)
+			VALUES ($1, $2)
+			ON CONFLICT (slug) DO NOTHING;`, oldSlug, userID)
+		if err != nil {
+			return fmt.Errorf("update profile: %w", err)
+		}
+	}
+	return nil
+}
+
+// SetAvatar crops the image to a square, scales it to AvatarSize and stores
+// it as the user's avatar, replacing any avatar they had. A FileError is
+// returned if the contents are not a png, gif or jpg image, or if the image has
+// more than MaxImagePixels.
+func (us *UserService) SetAvatar(userID int, contents io.Reader) error {
+	src, _, err := decodeImage(contents)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	// Crop the largest square from the middle of the image.
+	bounds := src.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	x := bounds.Min.X + (bounds.Dx()-side)/2
+	y := bounds.Min.Y + (bounds.Dy()-side)/2
+	crop := image.Rect(x, y, x+side, y+side)
+	dst := image.NewRGBA(image.Rect(0, 0, AvatarSize, AvatarSize))
+	// Avatars are stored as JPEGs, which have no transparency, so
+	// transparent images are put on a white background.
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Over, nil)
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	// Each avatar gets a new key so that browsers don't keep showing a
+	// cached copy of the old one.
+	key := fmt.Sprintf("avatars/user-%d-%d.jpg", userID, time.Now().UnixNano())
+	err = us.store().Put(key, &buf)
+	if err != nil {
+		return fmt.Errorf("set avatar: %w", err)
+	}
+	return us.replaceAvatar(userID, key)
+}
+
+// DeleteAvatar removes the user's avatar, if they have one.
+func (us *UserService) DeleteAvatar(userID int) error {
+	return us.replaceAvatar(userID, "")
+}
+
+// replaceAvatar points the user at the avatar with the key, or at none if the
+// key is empty, and deletes the file of the avatar it replaces.
+func (us *UserService) replaceAvatar(userID int, key string) error {
+	var newKey, oldKey sql.NullString
+	if key != "" {
+		newKey = sql.NullString{String: key, Valid: true}
+	}
+	row := us.DB.QueryRow(`
+		UPDATE users AS new
+		SET avatar_key = $2
+		FROM users AS old
+		WHERE new.id = $1 AND old.id = new.id
+		RETURNING old.avatar_key;`, userID, newKey)
+	err := row.Scan(&oldKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("replace avatar: %w", err)
+	}
+	if !oldKey.Valid {
+		return nil
+	}
+	err = us.store().Delete(oldKey.String)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("replace avatar: %w", err)
+	}
+	return nil
+}
+
+// OpenAvatar returns the contents of the user's avatar. Callers must close
+// the returned io.ReadCloser. fs.ErrNotExist is returned if the user has no
+// avatar.
+func (us *UserService) OpenAvatar(user *User) (io.ReadCloser, ObjectInfo, error) {
+	if user.AvatarKey == "" {
+		return nil, ObjectInfo{}, fs.ErrNotExist
+	}
+	contents, info, err := us.store().Get(user.AvatarKey)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ObjectInfo{}, fs.ErrNotExist
+		}
+		return nil, ObjectInfo{}, fmt.Errorf("open avatar: %w", err)
+	}
+	return contents, info, nil
+}
+
+func (us *UserService) store() ImageStore {
+	if us.Store == nil {
+		return &LocalImageStore{}
+	}
+	return us.Store
+}
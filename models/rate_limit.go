@@ -0,0 +1,249 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitStoreMemory   = "memory"
+	RateLimitStorePostgres = "postgres"
+)
+
+// RateLimit is a token bucket that holds Burst requests and refills completely
+// over Period, so that on average Burst requests are allowed per Period.
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// ParseRateLimit parses limits written as "requests/period", such as "10/1m".
+func ParseRateLimit(s string) (RateLimit, error) {
+	burstStr, periodStr, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("parse rate limit %q: missing period", s)
+	}
+	burst, err := strconv.Atoi(strings.TrimSpace(burstStr))
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("parse rate limit %q: %w", s, err)
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(periodStr))
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("parse rate limit %q: %w", s, err)
+	}
+	if burst <= 0 || period <= 0 {
+		return RateLimit{}, fmt.Errorf("parse rate limit %q: must be positive", s)
+	}
+	return RateLimit{Burst: burst, Period: period}, nil
+}
+
+func (rl RateLimit) String() string {
+	return fmt.Sprintf("%d/%v", rl.Burst, rl.Period)
+}
+
+// rate is the number of tokens added to the bucket per second.
+func (rl RateLimit) rate() float64 {
+	return float64(rl.Burst) / rl.Period.Seconds()
+}
+
+// RateLimitResult is the state of a bucket after taking a token from it.
+type RateLimitResult struct {
+	Allowed bool
+	Limit   int
+	// Remaining is the number of requests that can be made right away.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed. It is zero
+	// when Allowed is true.
+	RetryAfter time.Duration
+}
+
+// take removes a token from a bucket that had tokens at updatedAt and returns
+// the number of tokens left.
+func (rl RateLimit) take(tokens float64, updatedAt, now time.Time) (float64, RateLimitResult) {
+	rate := rl.rate()
+	tokens = math.Min(float64(rl.Burst), tokens+now.Sub(updatedAt).Seconds()*rate)
+	result := RateLimitResult{
+		Limit: rl.Burst,
+	}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((float64(rl.Burst) - tokens) / rate * float64(time.Second))
+	return tokens, result
+}
+
+// RateLimitStore keeps track of token buckets.
+type RateLimitStore interface {
+	// Take removes a token from the bucket for key, creating a full bucket if
+	// there isn't one.
+	Take(key string, limit RateLimit) (RateLimitResult, error)
+	// Sweep forgets buckets that have refilled every interval until the
+	// context is cancelled.
+	Sweep(ctx context.Context, interval time.Duration)
+}
+
+type rateLimitBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in memory. Limits only apply to a single
+// server process.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateLimitBucket
+}
+
+func (store *MemoryRateLimitStore) Take(key string, limit RateLimit) (RateLimitResult, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.buckets == nil {
+		store.buckets = make(map[string]*rateLimitBucket)
+	}
+	now := time.Now()
+	bucket, ok := store.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{
+			tokens:    float64(limit.Burst),
+			updatedAt: now,
+		}
+		store.buckets[key] = bucket
+	}
+	tokens, result := limit.take(bucket.tokens, bucket.updatedAt, now)
+	bucket.tokens = tokens
+	bucket.updatedAt = now
+	bucket.fullAt = now.Add(result.Reset)
+	return result, nil
+}
+
+// DeleteFull forgets buckets that have refilled, since they are the same as a
+// new bucket.
+func (store *MemoryRateLimitStore) DeleteFull() (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	var n int64
+	for key, bucket := range store.buckets {
+		if !bucket.fullAt.After(now) {
+			delete(store.buckets, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PostgresRateLimitStore keeps buckets in the database so that limits hold
+// across every server sharing it.
+type PostgresRateLimitStore struct {
+	DB *sql.DB
+}
+
+func (store *PostgresRateLimitStore) Take(key string, limit RateLimit) (RateLimitResult, error) {
+	tx, err := store.DB.Begin()
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("take: %w", err)
+	}
+	defer tx.Rollback()
+	// The database clock is used throughout so that servers with slightly
+	// different clocks agree on how full a bucket is.
+	_, err = tx.Exec(`
+		INSERT INTO rate_limit_buckets (key, tokens, updated_at, full_at)
+		VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (key) DO NOTHING;`, key, float64(limit.Burst))
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("take: %w", err)
+	}
+	var tokens float64
+	var updatedAt, now time.Time
+	row := tx.QueryRow(`
+		SELECT tokens, updated_at, NOW()
+		FROM rate_limit_buckets
+		WHERE key = $1
+		FOR UPDATE;`, key)
+	err = row.Scan(&tokens, &updatedAt, &now)
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("take: %w", err)
+	}
+	tokens, result := limit.take(tokens, updatedAt, now)
+	_, err = tx.Exec(`
+		UPDATE rate_limit_buckets
+		SET tokens = $2, updated_at = $3, full_at = $4
+		WHERE key = $1;`, key, tokens, now, now.Add(result.Reset))
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("take: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return RateLimitResult{}, fmt.Errorf("take: %w", err)
+	}
+	return result, nil
+}
+
+// DeleteFull removes buckets that have refilled, since they are the same as a
+// new bucket.
+func (store *PostgresRateLimitStore) DeleteFull() (int64, error) {
+	res, err := store.DB.Exec(`
+		DELETE FROM rate_limit_buckets
+		WHERE full_at <= NOW();`)
+	if err != nil {
+		return 0, fmt.Errorf("delete full: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete full: %w", err)
+	}
+	return n, nil
+}
+
+func (store *MemoryRateLimitStore) Sweep(ctx context.Context, interval time.Duration) {
+	sweepRateLimits(ctx, interval, store.DeleteFull)
+}
+
+func (store *PostgresRateLimitStore) Sweep(ctx context.Context, interval time.Duration) {
+	sweepRateLimits(ctx, interval, store.DeleteFull)
+}
+
+func sweepRateLimits(ctx context.Context, interval time.Duration, deleteFull func() (int64, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := deleteFull()
+		if err != nil {
+			log.Printf("sweeping rate limits: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d rate limit buckets", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// NewRateLimitStore returns the store for the backend, which is
+// RateLimitStoreMemory when empty.
+func NewRateLimitStore(backend string, db *sql.DB) (RateLimitStore, error) {
+	switch backend {
+	case "", RateLimitStoreMemory:
+		return &MemoryRateLimitStore{}, nil
+	case RateLimitStorePostgres:
+		return &PostgresRateLimitStore{DB: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit store %q", backend)
+	}
+}
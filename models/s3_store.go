@@ -0,0 +1,303 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type S3Config struct {
+	// Endpoint is the base URL of the S3 compatible service, for example
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000" for
+	// a local MinIO server.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses buckets as "{endpoint}/{bucket}/{key}" instead of
+	// "{bucket}.{endpoint}/{key}". MinIO and most self-hosted services need
+	// this.
+	PathStyle bool
+}
+
+// S3ImageStore stores images in an S3 compatible object store. Requests are
+// signed with AWS Signature Version 4.
+type S3ImageStore struct {
+	S3Config
+	// Client is used to make requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (s3 *S3ImageStore) Put(key string, contents io.Reader) error {
+	// The payload has to be hashed before it can be signed, so read it into
+	// memory. Uploads are already limited in size by the controllers.
+	body, err := io.ReadAll(contents)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	req, err := s3.newRequest(http.MethodPut, key, nil, body)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	req.Header.Set("Content-Type", contentType)
+	res, err := s3.do(req)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s3 *S3ImageStore) Get(key string) (io.ReadCloser, ObjectInfo, error) {
+	req, err := s3.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get: %w", err)
+	}
+	res, err := s3.do(req)
+	if err != nil {
+		return nil, ObjectInfo{}, fmt.Errorf("get: %w", err)
+	}
+	return res.Body, s3.objectInfo(key, res), nil
+}
+
+func (s3 *S3ImageStore) List(prefix string) ([]ObjectInfo, error) {
+	type listResult struct {
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}
+	}
+	var objects []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s3.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		res, err := s3.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("list: %w", err)
+		}
+		var result listResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list: decoding response: %w", err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:         c.Key,
+				Size:        c.Size,
+				ModTime:     c.LastModified,
+				ContentType: mime.TypeByExtension(path.Ext(c.Key)),
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return objects, nil
+}
+
+func (s3 *S3ImageStore) Delete(key string) error {
+	req, err := s3.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	res, err := s3.do(req)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (s3 *S3ImageStore) Stat(key string) (ObjectInfo, error) {
+	req, err := s3.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	res, err := s3.do(req)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("stat: %w", err)
+	}
+	res.Body.Close()
+	return s3.objectInfo(key, res), nil
+}
+
+// do sends the request and converts unsuccessful responses into errors. A 404
+// is reported as fs.ErrNotExist.
+func (s3 *S3ImageStore) do(req *http.Request) (*http.Response, error) {
+	client := s3.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+	body, _ := io.ReadAll(res.Body)
+	return nil, fmt.Errorf("HTTP %d: %s", res.StatusCode, string(body))
+}
+
+func (s3 *S3ImageStore) objectInfo(key string, res *http.Response) ObjectInfo {
+	info := ObjectInfo{
+		Key:         key,
+		ContentType: res.Header.Get("Content-Type"),
+	}
+	info.Size, _ = strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return info
+}
+
+// newRequest builds a signed request for the object with the given key. An
+// empty key addresses the bucket itself.
+func (s3 *S3ImageStore) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	endpoint, err := url.Parse(s3.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
+	}
+	u := *endpoint
+	escapedKey := s3Escape(key, false)
+	if s3.PathStyle {
+		u.Path = "/" + s3.Bucket
+		u.RawPath = "/" + s3Escape(s3.Bucket, true)
+		if key != "" {
+			u.Path += "/" + key
+			u.RawPath += "/" + escapedKey
+		}
+	} else {
+		u.Host = s3.Bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escapedKey
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s3.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s3 *S3ImageStore) sign(req *http.Request, body []byte, now time.Time) {
+	region := s3.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	payloadHex := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHex)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHex + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHex,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s3.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query with sorted keys as required by the
+// signing process. The same string is sent with the request.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but the RFC 3986 unreserved characters.
+// Slashes are left alone unless encodeSlash is true.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
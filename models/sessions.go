@@ -1,8 +1,39 @@
 package models
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	ErrSessionExpired = errors.New("models: session has expired")
+)
+
+const (
+	// DefaultSessionLifetime is how long a "remember me" session is valid
+	// for, no matter how active it is.
+	DefaultSessionLifetime = 30 * 24 * time.Hour
+	// DefaultBrowserSessionLifetime is how long a session is valid for when
+	// the user did not ask to be remembered.
+	DefaultBrowserSessionLifetime = 12 * time.Hour
+	// DefaultSessionIdleTimeout is how long a session can go unused before it
+	// expires.
+	DefaultSessionIdleTimeout = 3 * 24 * time.Hour
+	// DefaultSessionRotation is how often the token of an active session is
+	// replaced.
+	DefaultSessionRotation = 15 * time.Minute
+
+	// sessionTouchInterval limits how often LastSeenAt is written so that
+	// every request does not cause a database write.
+	sessionTouchInterval = 1 * time.Minute
+	// sessionRotationGrace is how long the previous token keeps working after
+	// a rotation, so that requests the browser sent before it received the
+	// new cookie still succeed.
+	sessionRotationGrace = 1 * time.Minute
 )
 
 type Session struct {
@@ -11,66 +42,286 @@ type Session struct {
 	// Token is only set when creating a new session. When looking up a session
 	// this will be left empty, as we only store the hash of a session token
 	// in our database and we cannot reverse it into a raw token.
-	Token     string
-	TokenHash string
+	Token      string
+	TokenHash  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	RotatedAt  time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	IPAddress  string
+	// Persistent sessions were created with "remember me" and should be stored
+	// in a cookie that outlives the browser session.
+	Persistent bool
 }
 
 type SessionService struct {
 	DB           *sql.DB
 	TokenManager *TokenManager
+
+	// Lifetime defaults to DefaultSessionLifetime.
+	Lifetime time.Duration
+	// BrowserLifetime defaults to DefaultBrowserSessionLifetime.
+	BrowserLifetime time.Duration
+	// IdleTimeout defaults to DefaultSessionIdleTimeout.
+	IdleTimeout time.Duration
+	// RotationInterval defaults to DefaultSessionRotation.
+	RotationInterval time.Duration
 }
 
 // Create will create a new session for the user provided. The session token
 // will be returned as the Token field on the Session type, but only the hashed
-// session token is stored in the database.
-func (ss *SessionService) Create(userID int) (*Session, error) {
+// session token is stored in the database. A user can have any number of
+// sessions, one for each device they sign in on.
+//
+// Persistent sessions last for the Lifetime of the service, others only for
+// the BrowserLifetime.
+func (ss *SessionService) Create(userID int, userAgent, ipAddress string, persistent bool) (*Session, error) {
 	token, tokenHash, err := ss.TokenManager.New()
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
 
+	lifetime := ss.BrowserLifetime
+	if lifetime == 0 {
+		lifetime = DefaultBrowserSessionLifetime
+	}
+	if persistent {
+		lifetime = ss.Lifetime
+		if lifetime == 0 {
+			lifetime = DefaultSessionLifetime
+		}
+	}
 	session := Session{
-		UserID:    userID,
-		Token:     token,
-		TokenHash: tokenHash,
+		UserID:     userID,
+		Token:      token,
+		TokenHash:  tokenHash,
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		Persistent: persistent,
+		ExpiresAt:  time.Now().Add(lifetime),
 	}
 	row := ss.DB.QueryRow(`
-		INSERT INTO sessions (user_id, token_hash)
-		VALUES ($1, $2) ON CONFLICT (user_id) DO
-		UPDATE
-		SET token_hash = $2
-		RETURNING id;`, session.UserID, session.TokenHash)
-	err = row.Scan(&session.ID)
+		INSERT INTO sessions (user_id, token_hash, user_agent, ip_address, persistent, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, last_seen_at, rotated_at;`,
+		session.UserID, session.TokenHash, session.UserAgent, session.IPAddress,
+		session.Persistent, session.ExpiresAt)
+	err = row.Scan(&session.ID, &session.CreatedAt, &session.LastSeenAt, &session.RotatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
 	return &session, nil
 }
 
-func (ss *SessionService) User(token string) (*User, error) {
+// Refresh looks up the session for the token and returns it along with its
+// user. Sessions past their lifetime or idle timeout are deleted and
+// ErrSessionExpired is returned.
+//
+// Refresh also records that the session was just used and, once every
+// RotationInterval, replaces the session token. When that happens the new
+// token is set on the returned Session's Token field and the caller must hand
+// it to the client. The old token keeps working for a short grace period.
+func (ss *SessionService) Refresh(token string) (*Session, *User, error) {
+	var session Session
 	var user User
 	tokenHash := ss.TokenManager.Hash(token)
 	row := ss.DB.QueryRow(`
-		SELECT users.id,
+		SELECT sessions.id,
+			sessions.token_hash,
+			sessions.created_at,
+			sessions.last_seen_at,
+			sessions.rotated_at,
+			sessions.expires_at,
+			sessions.persistent,
+			users.id,
 			users.email,
-			users.password_hash
+			users.password_hash,
+			users.email_verified_at
 		FROM sessions 
 			JOIN users ON users.id = sessions.user_id 
-		WHERE sessions.token_hash = $1;`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+		WHERE sessions.token_hash = $1
+			OR (sessions.previous_token_hash = $1 AND sessions.rotated_at > $2);`,
+		tokenHash, time.Now().Add(-sessionRotationGrace))
+	err := row.Scan(&session.ID, &session.TokenHash, &session.CreatedAt,
+		&session.LastSeenAt, &session.RotatedAt, &session.ExpiresAt, &session.Persistent,
+		&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrNotFound
+		}
+		return nil, nil, fmt.Errorf("refresh: %w", err)
+	}
+	session.UserID = user.ID
+
+	now := time.Now()
+	if now.After(session.ExpiresAt) || now.Sub(session.LastSeenAt) > ss.idleTimeout() {
+		_, err = ss.DB.Exec(`
+			DELETE FROM sessions
+			WHERE id = $1;`, session.ID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("refresh: %w", err)
+		}
+		return nil, nil, ErrSessionExpired
+	}
+
+	// Only rotate when the current token was used. A request made with the
+	// previous token raced the last rotation and the client is about to
+	// receive the new token anyway.
+	if session.TokenHash == tokenHash && now.Sub(session.RotatedAt) > ss.rotationInterval() {
+		newToken, newTokenHash, err := ss.TokenManager.New()
+		if err != nil {
+			return nil, nil, fmt.Errorf("refresh: %w", err)
+		}
+		_, err = ss.DB.Exec(`
+			UPDATE sessions
+			SET previous_token_hash = token_hash, token_hash = $2,
+				rotated_at = $3, last_seen_at = $3
+			WHERE id = $1;`, session.ID, newTokenHash, now)
+		if err != nil {
+			return nil, nil, fmt.Errorf("refresh: %w", err)
+		}
+		session.Token = newToken
+		session.TokenHash = newTokenHash
+		session.RotatedAt = now
+		session.LastSeenAt = now
+		return &session, &user, nil
+	}
+
+	if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		_, err = ss.DB.Exec(`
+			UPDATE sessions
+			SET last_seen_at = $2
+			WHERE id = $1;`, session.ID, now)
+		if err != nil {
+			return nil, nil, fmt.Errorf("refresh: %w", err)
+		}
+		session.LastSeenAt = now
+	}
+	return &session, &user, nil
+}
+
+func (ss *SessionService) idleTimeout() time.Duration {
+	if ss.IdleTimeout == 0 {
+		return DefaultSessionIdleTimeout
+	}
+	return ss.IdleTimeout
+}
+
+func (ss *SessionService) rotationInterval() time.Duration {
+	if ss.RotationInterval == 0 {
+		return DefaultSessionRotation
+	}
+	return ss.RotationInterval
+}
+
+// ByUserID returns all of the user's sessions that are still valid, most
+// recently used first.
+func (ss *SessionService) ByUserID(userID int) ([]Session, error) {
+	rows, err := ss.DB.Query(`
+		SELECT id, token_hash, created_at, last_seen_at, rotated_at, expires_at,
+			user_agent, ip_address, persistent
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > NOW() AND last_seen_at > $2
+		ORDER BY last_seen_at DESC;`, userID, time.Now().Add(-ss.idleTimeout()))
 	if err != nil {
-		return nil, fmt.Errorf("user: %w", err)
+		return nil, fmt.Errorf("query sessions by user: %w", err)
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err := rows.Scan(&session.ID, &session.TokenHash, &session.CreatedAt,
+			&session.LastSeenAt, &session.RotatedAt, &session.ExpiresAt,
+			&session.UserAgent, &session.IPAddress, &session.Persistent)
+		if err != nil {
+			return nil, fmt.Errorf("query sessions by user: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query sessions by user: %w", err)
 	}
-	return &user, nil
+	return sessions, nil
 }
 
 func (ss *SessionService) Delete(token string) error {
 	tokenHash := ss.TokenManager.Hash(token)
 	_, err := ss.DB.Exec(`
 		DELETE FROM sessions
-		WHERE token_hash = $1;`, tokenHash)
+		WHERE token_hash = $1 OR previous_token_hash = $1;`, tokenHash)
 	if err != nil {
 		return fmt.Errorf("delete: %w", err)
 	}
 	return nil
 }
+
+// DeleteByID deletes one of the user's sessions. ErrNotFound is returned if
+// the session does not exist or belongs to another user.
+func (ss *SessionService) DeleteByID(userID, sessionID int) error {
+	var id int
+	row := ss.DB.QueryRow(`
+		DELETE FROM sessions
+		WHERE id = $1 AND user_id = $2
+		RETURNING id;`, sessionID, userID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete by id: %w", err)
+	}
+	return nil
+}
+
+// DeleteOthers deletes all of the user's sessions except the one for the
+// given token, signing the user out on every other device.
+func (ss *SessionService) DeleteOthers(userID int, token string) error {
+	tokenHash := ss.TokenManager.Hash(token)
+	_, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE user_id = $1 AND token_hash <> $2
+			AND previous_token_hash IS DISTINCT FROM $2;`, userID, tokenHash)
+	if err != nil {
+		return fmt.Errorf("delete others: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired deletes sessions that have expired or gone unused for longer
+// than the idle timeout, and returns how many were deleted.
+func (ss *SessionService) DeleteExpired() (int64, error) {
+	result, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE expires_at <= NOW() OR last_seen_at <= $1;`,
+		time.Now().Add(-ss.idleTimeout()))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep calls DeleteExpired every interval until the context is cancelled.
+func (ss *SessionService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := ss.DeleteExpired()
+		if err != nil {
+			log.Printf("sweeping sessions: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d expired sessions", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrShareLinkExpired = errors.New("models: share link has expired")
+)
+
+// ShareLinkViewGrace is how long the images of a gallery keep loading with a
+// share link after its last view has been used, so the page that used it up
+// can finish loading.
+const ShareLinkViewGrace = time.Hour
+
+// ShareLink gives anyone who has its token read access to one gallery, even
+// when the gallery is private.
+type ShareLink struct {
+	ID        int
+	GalleryID int
+	// Token goes in the link. It is signed rather than stored, so it can be
+	// shown again whenever the owner lists the gallery's links.
+	Token     string
+	CreatedAt time.Time
+	// ExpiresAt is nil for links that never expire.
+	ExpiresAt *time.Time
+	// MaxViews is nil for links that can be viewed any number of times.
+	MaxViews *int
+	Views    int
+}
+
+type ShareLinkService struct {
+	DB *sql.DB
+	// Key signs share link tokens. Changing it breaks every existing link.
+	Key []byte
+}
+
+// Create makes a new share link for the gallery. A nil expiresAt or maxViews
+// leaves the link without that limit.
+func (sls *ShareLinkService) Create(galleryID int, expiresAt *time.Time, maxViews *int) (*ShareLink, error) {
+	link := ShareLink{
+		GalleryID: galleryID,
+		ExpiresAt: expiresAt,
+		MaxViews:  maxViews,
+	}
+	row := sls.DB.QueryRow(`
+		INSERT INTO gallery_share_links (gallery_id, expires_at, max_views)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at;`, galleryID, expiresAt, maxViews)
+	err := row.Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	link.Token = sls.token(link.GalleryID, link.ID)
+	return &link, nil
+}
+
+// Use checks that the token is for an active share link to the gallery.
+// ErrNotFound is returned for bad or revoked tokens and ErrShareLinkExpired
+// for links past their expiry or view limit.
+//
+// When view is set the visit counts toward the link's view limit. Only
+// viewing the gallery page should count. The images on it are requested with
+// the same token without counting a view; they are allowed while the link has
+// views left, and for ShareLinkViewGrace after the last one was used.
+func (sls *ShareLinkService) Use(galleryID int, token string, view bool) error {
+	id, ok := sls.verify(galleryID, token)
+	if !ok {
+		return ErrNotFound
+	}
+	var link ShareLink
+	var lastViewedAt *time.Time
+	row := sls.DB.QueryRow(`
+		SELECT expires_at, max_views, views, last_viewed_at
+		FROM gallery_share_links
+		WHERE id = $1 AND gallery_id = $2;`, id, galleryID)
+	err := row.Scan(&link.ExpiresAt, &link.MaxViews, &link.Views, &lastViewedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("use share link: %w", err)
+	}
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		return ErrShareLinkExpired
+	}
+	if !view {
+		if link.MaxViews != nil && link.Views >= *link.MaxViews {
+			if lastViewedAt == nil || time.Since(*lastViewedAt) > ShareLinkViewGrace {
+				return ErrShareLinkExpired
+			}
+		}
+		return nil
+	}
+	// The limit is checked again while counting the view so that concurrent
+	// visits can't go over it.
+	res, err := sls.DB.Exec(`
+		UPDATE gallery_share_links
+		SET views = views + 1, last_viewed_at = NOW()
+		WHERE id = $1 AND (max_views IS NULL OR views < max_views);`, id)
+	if err != nil {
+		return fmt.Errorf("use share link: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("use share link: %w", err)
+	}
+	if n == 0 {
+		return ErrShareLinkExpired
+	}
+	return nil
+}
+
+// ByGalleryID returns the gallery's active share links, newest first.
+func (sls *ShareLinkService) ByGalleryID(galleryID int) ([]ShareLink, error) {
+	rows, err := sls.DB.Query(`
+		SELECT id, created_at, expires_at, max_views, views
+		FROM gallery_share_links
+		WHERE gallery_id = $1
+			AND (expires_at IS NULL OR expires_at > NOW())
+			AND (max_views IS NULL OR views < max_views)
+		ORDER BY created_at DESC, id DESC;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query share links by gallery: %w", err)
+	}
+	defer rows.Close()
+	var links []ShareLink
+	for rows.Next() {
+		link := ShareLink{
+			GalleryID: galleryID,
+		}
+		err := rows.Scan(&link.ID, &link.CreatedAt, &link.ExpiresAt, &link.MaxViews, &link.Views)
+		if err != nil {
+			return nil, fmt.Errorf("query share links by gallery: %w", err)
+		}
+		link.Token = sls.token(galleryID, link.ID)
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query share links by gallery: %w", err)
+	}
+	return links, nil
+}
+
+// Delete revokes one of the gallery's share links. ErrNotFound is returned if
+// the link does not exist or belongs to another gallery.
+func (sls *ShareLinkService) Delete(galleryID, id int) error {
+	row := sls.DB.QueryRow(`
+		DELETE FROM gallery_share_links
+		WHERE id = $1 AND gallery_id = $2
+		RETURNING id;`, id, galleryID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete share link: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes share links that can no longer be used and returns
+// how many were removed. Links that have used up their views are kept until
+// their images stop loading too.
+func (sls *ShareLinkService) DeleteExpired() (int64, error) {
+	res, err := sls.DB.Exec(`
+		DELETE FROM gallery_share_links
+		WHERE expires_at <= NOW()
+			OR (views >= max_views
+				AND (last_viewed_at IS NULL OR last_viewed_at <= $1));`,
+		time.Now().Add(-ShareLinkViewGrace))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired share links: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete expired share links: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep calls DeleteExpired every interval until the context is cancelled.
+func (sls *ShareLinkService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := sls.DeleteExpired()
+		if err != nil {
+			log.Printf("sweeping share links: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d expired share links", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// token is the link ID followed by a signature over the gallery and link IDs.
+func (sls *ShareLinkService) token(galleryID, id int) string {
+	return strconv.Itoa(id) + "." + sls.sign(galleryID, id)
+}
+
+func (sls *ShareLinkService) verify(galleryID int, token string) (id int, ok bool) {
+	idStr, sig, found := strings.Cut(token, ".")
+	if !found {
+		return 0, false
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, false
+	}
+	if !hmac.Equal([]byte(sig), []byte(sls.sign(galleryID, id))) {
+		return 0, false
+	}
+	return id, true
+}
+
+func (sls *ShareLinkService) sign(galleryID, id int) string {
+	mac := hmac.New(sha256.New, sls.Key)
+	fmt.Fprintf(mac, "gallery-share-link:%d:%d", galleryID, id)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"sync"
+	"time"
+
+	mail "github.com/go-mail/mail/v2"
+)
+
+const (
+	// SMTPStartTLS connects in plain text and requires the server to upgrade
+	// the connection with STARTTLS. This is what port 587 expects.
+	SMTPStartTLS = "starttls"
+	// SMTPImplicitTLS connects over TLS from the start. This is what port 465
+	// expects.
+	SMTPImplicitTLS = "tls"
+	// SMTPNoTLS never encrypts the connection. Only use it with a local SMTP
+	// server for development.
+	SMTPNoTLS = "none"
+)
+
+// ErrEmailMaybeSent is returned when the connection to the server failed after
+// the whole message had been sent but before the server replied, so it may
+// have delivered it anyway. Sending it again could deliver it twice.
+var ErrEmailMaybeSent = errors.New("models: email may have been sent")
+
+// DefaultSMTPIdleTimeout is how long a connection is kept open after the last
+// email, in case another one is sent soon after.
+const DefaultSMTPIdleTimeout = 30 * time.Second
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// TLS is one of SMTPStartTLS, SMTPImplicitTLS or SMTPNoTLS. It defaults
+	// to SMTPImplicitTLS on port 465 and SMTPStartTLS otherwise.
+	TLS string
+	// IdleTimeout defaults to DefaultSMTPIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// SMTPEmailer sends emails through an SMTP server. The connection is reused
+// between emails and closed once it has been idle for IdleTimeout.
+type SMTPEmailer struct {
+	dialer      *mail.Dialer
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	conn      mail.SendCloser
+	idleTimer *time.Timer
+}
+
+func NewSMTPEmailer(cfg SMTPConfig) (*SMTPEmailer, error) {
+	if cfg.Host == "" {
+		return nil, fmt.Errorf("new smtp emailer: host is required")
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	dialer := mail.NewDialer(cfg.Host, port, cfg.Username, cfg.Password)
+	tlsMode := cfg.TLS
+	if tlsMode == "" {
+		tlsMode = SMTPStartTLS
+		if port == 465 {
+			tlsMode = SMTPImplicitTLS
+		}
+	}
+	switch tlsMode {
+	case SMTPStartTLS:
+		dialer.StartTLSPolicy = mail.MandatoryStartTLS
+	case SMTPImplicitTLS:
+		dialer.SSL = true
+	case SMTPNoTLS:
+		dialer.StartTLSPolicy = mail.NoStartTLS
+	default:
+		return nil, fmt.Errorf("new smtp emailer: unknown TLS mode %q", cfg.TLS)
+	}
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultSMTPIdleTimeout
+	}
+	return &SMTPEmailer{
+		dialer:      dialer,
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+func (se *SMTPEmailer) DialAndSend(email *Email) error {
+	msg := newMailMessage(email)
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if se.idleTimer != nil {
+		se.idleTimer.Stop()
+	}
+	reused := se.conn != nil
+	progress, err := se.send(msg)
+	if err != nil && reused && !progress.written {
+		// The server may have dropped a connection that sat idle, so try
+		// once more with a fresh one. A message that has been written may
+		// have been accepted, so it isn't sent again.
+		se.closeConn()
+		progress, err = se.send(msg)
+	}
+	if err != nil {
+		se.closeConn()
+		if progress.maybeSent() {
+			return fmt.Errorf("dialandsend: %w: %w", ErrEmailMaybeSent, err)
+		}
+		return fmt.Errorf("dialandsend: %w", err)
+	}
+	se.idleTimer = time.AfterFunc(se.idleTimeout, se.Close)
+	return nil
+}
+
+// send sends the message over the open connection, or a new one if there
+// isn't one, and reports how far it got.
+func (se *SMTPEmailer) send(msg *mail.Message) (*progressSender, error) {
+	progress := &progressSender{}
+	if se.conn == nil {
+		conn, err := se.dialer.Dial()
+		if err != nil {
+			return progress, err
+		}
+		se.conn = conn
+	}
+	progress.Sender = se.conn
+	err := mail.Send(progress, msg)
+	return progress, err
+}
+
+// progressSender records how far sending a message got, which decides
+// whether it is safe to send it again.
+type progressSender struct {
+	mail.Sender
+	// written is set once the whole message has been written. That only
+	// happens after the server has accepted its sender and recipients.
+	written bool
+	// answered is set if the server replied to the written message with an
+	// error, so it is known not to have been accepted.
+	answered bool
+}
+
+func (ps *progressSender) Send(from string, to []string, msg io.WriterTo) error {
+	err := ps.Sender.Send(from, to, writerToFunc(func(w io.Writer) (int64, error) {
+		n, err := msg.WriteTo(w)
+		ps.written = err == nil
+		return n, err
+	}))
+	var reply *textproto.Error
+	ps.answered = ps.written && errors.As(err, &reply)
+	return err
+}
+
+// maybeSent reports whether the server may have accepted the message even
+// though sending it failed: it was written, but the connection failed
+// before the server replied.
+func (ps *progressSender) maybeSent() bool {
+	return ps.written && !ps.answered
+}
+
+type writerToFunc func(w io.Writer) (int64, error)
+
+func (f writerToFunc) WriteTo(w io.Writer) (int64, error) {
+	return f(w)
+}
+
+// Close closes the connection to the SMTP server if there is one. A new one
+// is opened when the next email is sent.
+func (se *SMTPEmailer) Close() {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.closeConn()
+}
+
+func (se *SMTPEmailer) closeConn() {
+	if se.conn == nil {
+		return
+	}
+	// The connection is being thrown away, so there is nothing to do if the
+	// server doesn't answer QUIT.
+	se.conn.Close()
+	se.conn = nil
+}
+
+func newMailMessage(email *Email) *mail.Message {
+	msg := mail.NewMessage()
+	msg.SetHeader("From", email.From)
+	msg.SetHeader("To", email.To)
+	msg.SetHeader("Subject", email.Subject)
+	switch {
+	case email.Text != "" && email.HTML != "":
+		msg.SetBody("text/plain", email.Text)
+		msg.AddAlternative("text/html", email.HTML)
+	case email.HTML != "":
+		msg.SetBody("text/html", email.HTML)
+	default:
+		msg.SetBody("text/plain", email.Text)
+	}
+	return msg
+}
@@ -0,0 +1,326 @@
+package models
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is a stand-in for an SMTP server that accepts every email, unless
+// respond says otherwise.
+type fakeSMTP struct {
+	listener net.Listener
+	// respond can override the reply to a command, or to the end of the
+	// data when cmd is ".". Returning an empty reply sends the usual one,
+	// and drop closes the connection without replying.
+	respond func(session fakeSMTPSession, cmd string) (reply string, drop bool)
+
+	mu       sync.Mutex
+	conns    int
+	quits    int
+	messages []string
+}
+
+// fakeSMTPSession is the state of one connection to the fakeSMTP.
+type fakeSMTPSession struct {
+	// Conn counts connections from 1.
+	Conn int
+	// Sent is how many emails were accepted on this connection so far.
+	Sent int
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	f := &fakeSMTP{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeSMTP) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns++
+		session := fakeSMTPSession{Conn: f.conns}
+		f.mu.Unlock()
+		go f.handle(conn, session)
+	}
+}
+
+func (f *fakeSMTP) handle(conn net.Conn, session fakeSMTPSession) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, _, _ := strings.Cut(strings.ToUpper(line), " ")
+		cmd, _, _ = strings.Cut(cmd, ":")
+		var data strings.Builder
+		if cmd == "DATA" {
+			reply("354 go ahead")
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			cmd = "."
+		}
+		var custom string
+		if f.respond != nil {
+			var drop bool
+			custom, drop = f.respond(session, cmd)
+			if drop {
+				return
+			}
+		}
+		if custom != "" {
+			reply(custom)
+			if strings.HasPrefix(custom, "421") {
+				return
+			}
+			continue
+		}
+		switch cmd {
+		case "EHLO", "HELO":
+			reply("250 fake")
+		case ".":
+			f.mu.Lock()
+			f.messages = append(f.messages, data.String())
+			f.mu.Unlock()
+			session.Sent++
+			reply("250 queued")
+		case "QUIT":
+			f.mu.Lock()
+			f.quits++
+			f.mu.Unlock()
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// counts returns the number of connections, QUITs and accepted emails.
+func (f *fakeSMTP) counts() (conns, quits, messages int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns, f.quits, len(f.messages)
+}
+
+func newTestSMTPEmailer(t *testing.T, f *fakeSMTP, idleTimeout time.Duration) *SMTPEmailer {
+	addr := f.listener.Addr().(*net.TCPAddr)
+	se, err := NewSMTPEmailer(SMTPConfig{
+		Host:        addr.IP.String(),
+		Port:        addr.Port,
+		TLS:         SMTPNoTLS,
+		IdleTimeout: idleTimeout,
+	})
+	if err != nil {
+		t.Fatalf("NewSMTPEmailer() err = %v", err)
+	}
+	t.Cleanup(se.Close)
+	return se
+}
+
+func testEmail(subject string) *Email {
+	return &Email{
+		From:    "support@lenslocked.com",
+		To:      "jon@example.com",
+		Subject: subject,
+		Text:    "Hello",
+	}
+}
+
+func TestSMTPEmailerReusesConnection(t *testing.T) {
+	f := newFakeSMTP(t)
+	se := newTestSMTPEmailer(t, f, time.Minute)
+	for _, subject := range []string{"First", "Second"} {
+		err := se.DialAndSend(testEmail(subject))
+		if err != nil {
+			t.Fatalf("DialAndSend(%q) err = %v", subject, err)
+		}
+	}
+	conns, _, messages := f.counts()
+	if conns != 1 || messages != 2 {
+		t.Errorf("got %d connections and %d emails, want 1 and 2", conns, messages)
+	}
+	if !strings.Contains(f.messages[1], "Subject: Second") {
+		t.Errorf("second email = %q, want the Second subject", f.messages[1])
+	}
+}
+
+func TestSMTPEmailerClosesIdleConnection(t *testing.T) {
+	f := newFakeSMTP(t)
+	se := newTestSMTPEmailer(t, f, 20*time.Millisecond)
+	err := se.DialAndSend(testEmail("First"))
+	if err != nil {
+		t.Fatalf("DialAndSend() err = %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, quits, _ := f.counts()
+		if quits == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection was not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	err = se.DialAndSend(testEmail("Second"))
+	if err != nil {
+		t.Fatalf("DialAndSend() after idle close err = %v", err)
+	}
+	conns, _, messages := f.counts()
+	if conns != 2 || messages != 2 {
+		t.Errorf("got %d connections and %d emails, want 2 and 2", conns, messages)
+	}
+}
+
+func TestSMTPEmailerReconnectsAfterDroppedConnection(t *testing.T) {
+	f := newFakeSMTP(t)
+	// The server gives up on the first connection once it has sent an
+	// email, as servers do with connections that sit idle for too long.
+	f.respond = func(session fakeSMTPSession, cmd string) (string, bool) {
+		if session.Conn == 1 && session.Sent == 1 && cmd == "MAIL" {
+			return "421 timeout, closing connection", false
+		}
+		return "", false
+	}
+	se := newTestSMTPEmailer(t, f, time.Minute)
+	for _, subject := range []string{"First", "Second"} {
+		err := se.DialAndSend(testEmail(subject))
+		if err != nil {
+			t.Fatalf("DialAndSend(%q) err = %v", subject, err)
+		}
+	}
+	conns, _, messages := f.counts()
+	if conns != 2 || messages != 2 {
+		t.Errorf("got %d connections and %d emails, want 2 and 2", conns, messages)
+	}
+}
+
+func TestSMTPEmailerFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(session fakeSMTPSession, cmd string) (string, bool)
+		// first sends an email before the one that fails, so that the
+		// failing one reuses the connection.
+		first     bool
+		maybeSent bool
+		wantConns int
+	}{
+		{
+			name: "recipient rejected",
+			respond: func(session fakeSMTPSession, cmd string) (string, bool) {
+				if cmd == "RCPT" {
+					return "550 no such user", false
+				}
+				return "", false
+			},
+			wantConns: 1,
+		},
+		{
+			name: "recipient rejected on reused connection",
+			respond: func(session fakeSMTPSession, cmd string) (string, bool) {
+				if cmd == "RCPT" && (session.Conn > 1 || session.Sent > 0) {
+					return "550 no such user", false
+				}
+				return "", false
+			},
+			first: true,
+			// Rejected before the message was written, so it is tried
+			// once more on a new connection.
+			wantConns: 2,
+		},
+		{
+			name: "connection dropped after the message",
+			respond: func(session fakeSMTPSession, cmd string) (string, bool) {
+				return "", cmd == "."
+			},
+			maybeSent: true,
+			wantConns: 1,
+		},
+		{
+			name: "connection dropped after the message on reused connection",
+			respond: func(session fakeSMTPSession, cmd string) (string, bool) {
+				return "", cmd == "." && session.Sent > 0
+			},
+			first:     true,
+			maybeSent: true,
+			// Not retried, since the server may have accepted it.
+			wantConns: 1,
+		},
+		{
+			name: "message rejected",
+			respond: func(session fakeSMTPSession, cmd string) (string, bool) {
+				if cmd == "." {
+					return "554 rejected as spam", false
+				}
+				return "", false
+			},
+			// The server said it didn't take it.
+			wantConns: 1,
+		},
+		{
+			name: "message rejected on reused connection",
+			respond: func(session fakeSMTPSession, cmd string) (string, bool) {
+				if cmd == "." && session.Sent > 0 {
+					return "451 try again later", false
+				}
+				return "", false
+			},
+			first: true,
+			// Only connections that fail before the message is written
+			// are retried right away.
+			wantConns: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeSMTP(t)
+			f.respond = tt.respond
+			se := newTestSMTPEmailer(t, f, time.Minute)
+			if tt.first {
+				err := se.DialAndSend(testEmail("First"))
+				if err != nil {
+					t.Fatalf("DialAndSend() of the first email err = %v", err)
+				}
+			}
+			err := se.DialAndSend(testEmail("Failing"))
+			if err == nil {
+				t.Fatal("DialAndSend() err = nil, want an error")
+			}
+			if got := errors.Is(err, ErrEmailMaybeSent); got != tt.maybeSent {
+				t.Errorf("errors.Is(%v, ErrEmailMaybeSent) = %v, want %v", err, got, tt.maybeSent)
+			}
+			if conns, _, _ := f.counts(); conns != tt.wantConns {
+				t.Errorf("got %d connections, want %d", conns, tt.wantConns)
+			}
+		})
+	}
+}
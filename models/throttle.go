@@ -0,0 +1,269 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ThrottleAction groups attempts that are counted together.
+type ThrottleAction string
+
+const (
+	// ThrottleSignIn counts failed password sign ins.
+	ThrottleSignIn ThrottleAction = "sign-in"
+	// ThrottleEmail counts requests that email a link to an address, such as
+	// password resets and passwordless sign in, so that they can't be used to
+	// flood someone's inbox.
+	ThrottleEmail ThrottleAction = "email"
+)
+
+// ThrottlePolicy decides how long attempts are blocked for after repeated
+// failures.
+type ThrottlePolicy struct {
+	// FreeAttempts is how many failures are allowed before any delay.
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure past FreeAttempts. Each
+	// further failure doubles it, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter is the number of failures that locks attempts for
+	// LockoutDuration.
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered. The count starts over when
+	// there has been no failure for this long.
+	Window time.Duration
+}
+
+var (
+	// DefaultAccountThrottle applies to a single email address.
+	DefaultAccountThrottle = ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	// DefaultIPThrottle applies to a single IP address. It is more lenient than
+	// DefaultAccountThrottle because many people can share an address.
+	DefaultIPThrottle = ThrottlePolicy{
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	}
+)
+
+// delay returns how long attempts are blocked for after the given number of
+// failures, and whether that is a lockout.
+func (p ThrottlePolicy) delay(failures int) (time.Duration, bool) {
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.LockoutDuration, true
+	}
+	if failures <= p.FreeAttempts {
+		return 0, false
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay, false
+}
+
+// ThrottledError is returned when an attempt is blocked.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (te ThrottledError) Error() string {
+	return fmt.Sprintf("models: too many attempts, retry after %v", te.RetryAfter)
+}
+
+// Lockout describes an account that was just locked.
+type Lockout struct {
+	Email string
+	Until time.Time
+}
+
+// ThrottleService tracks failed attempts per IP address and per account.
+// Accounts are identified by the email address that was entered, whether or
+// not an account with that address exists, so that throttling never reveals
+// which addresses have accounts.
+type ThrottleService struct {
+	DB *sql.DB
+
+	// Account defaults to DefaultAccountThrottle.
+	Account *ThrottlePolicy
+	// IP defaults to DefaultIPThrottle.
+	IP *ThrottlePolicy
+}
+
+// Allow returns a ThrottledError if attempts for the action are currently
+// blocked for either the IP address or the email address.
+func (ts *ThrottleService) Allow(action ThrottleAction, ip, email string) error {
+	var blockedUntil sql.NullTime
+	row := ts.DB.QueryRow(`
+		SELECT MAX(blocked_until)
+		FROM throttles
+		WHERE key IN ($1, $2) AND blocked_until > NOW();`,
+		ipThrottleKey(action, ip), accountThrottleKey(action, email))
+	err := row.Scan(&blockedUntil)
+	if err != nil {
+		return fmt.Errorf("allow: %w", err)
+	}
+	if blockedUntil.Valid {
+		return ThrottledError{RetryAfter: time.Until(blockedUntil.Time)}
+	}
+	return nil
+}
+
+// Record counts a failed attempt against both the IP address and the email
+// address. If this attempt locked the account, the returned Lockout is not
+// nil so that the owner can be told about it.
+func (ts *ThrottleService) Record(action ThrottleAction, ip, email string) (*Lockout, error) {
+	_, _, err := ts.record(ipThrottleKey(action, ip), ts.ipPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	until, lockedNow, err := ts.record(accountThrottleKey(action, email), ts.accountPolicy())
+	if err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	if !lockedNow {
+		return nil, nil
+	}
+	return &Lockout{
+		Email: normalizeThrottleEmail(email),
+		Until: until,
+	}, nil
+}
+
+// Reset forgets the failed attempts for the email address, for instance after
+// a successful sign in. Failures from the IP address are kept so that an
+// attacker can't clear them by signing in to their own account.
+func (ts *ThrottleService) Reset(action ThrottleAction, email string) error {
+	_, err := ts.DB.Exec(`
+		DELETE FROM throttles
+		WHERE key = $1;`, accountThrottleKey(action, email))
+	if err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	return nil
+}
+
+// DeleteStale removes throttles that are no longer blocking and whose
+// failures have been forgotten.
+func (ts *ThrottleService) DeleteStale() (int64, error) {
+	window := ts.accountPolicy().Window
+	if ipWindow := ts.ipPolicy().Window; ipWindow > window {
+		window = ipWindow
+	}
+	res, err := ts.DB.Exec(`
+		DELETE FROM throttles
+		WHERE updated_at < $1
+		AND (blocked_until IS NULL OR blocked_until <= NOW());`, time.Now().Add(-window))
+	if err != nil {
+		return 0, fmt.Errorf("delete stale: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete stale: %w", err)
+	}
+	return n, nil
+}
+
+// Sweep calls DeleteStale every interval until the context is cancelled.
+func (ts *ThrottleService) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := ts.DeleteStale()
+		if err != nil {
+			log.Printf("sweeping throttles: %v", err)
+		} else if n > 0 {
+			log.Printf("swept %d stale throttles", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record counts a failure for the key and blocks it according to the policy.
+// lockedNow is true only for the failure that reaches the lockout threshold.
+func (ts *ThrottleService) record(key string, policy ThrottlePolicy) (until time.Time, lockedNow bool, err error) {
+	tx, err := ts.DB.Begin()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+	var failures int
+	row := tx.QueryRow(`
+		INSERT INTO throttles (key, failures)
+		VALUES ($1, 1)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN throttles.updated_at < $2 THEN 1
+				ELSE throttles.failures + 1
+			END,
+			updated_at = NOW()
+		RETURNING failures;`, key, time.Now().Add(-policy.Window))
+	err = row.Scan(&failures)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	delay, locked := policy.delay(failures)
+	if delay > 0 {
+		until = time.Now().Add(delay)
+		_, err = tx.Exec(`
+			UPDATE throttles
+			SET blocked_until = $2
+			WHERE key = $1;`, key, until)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return until, locked && failures == policy.LockoutAfter, nil
+}
+
+func (ts *ThrottleService) accountPolicy() ThrottlePolicy {
+	if ts.Account == nil {
+		return DefaultAccountThrottle
+	}
+	return *ts.Account
+}
+
+func (ts *ThrottleService) ipPolicy() ThrottlePolicy {
+	if ts.IP == nil {
+		return DefaultIPThrottle
+	}
+	return *ts.IP
+}
+
+func ipThrottleKey(action ThrottleAction, ip string) string {
+	return string(action) + ":ip:" + ip
+}
+
+func accountThrottleKey(action ThrottleAction, email string) string {
+	return string(action) + ":account:" + normalizeThrottleEmail(email)
+}
+
+func normalizeThrottleEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,401 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/silasburger/lenslocked/rand"
+)
+
+var (
+	ErrTwoFactorCodeInvalid = errors.New("models: invalid two-factor code")
+	ErrTwoFactorNotPending  = errors.New("models: two-factor enrollment has not been started")
+)
+
+const (
+	// TOTP parameters from RFC 6238. These are the defaults every
+	// authenticator app supports.
+	totpDigits = 6
+	totpPeriod = 30
+	// totpSkew is how many periods before and after the current one are
+	// accepted, to allow for clock drift and slow typing.
+	totpSkew = 1
+
+	totpSecretBytes = 20
+
+	// RecoveryCodeCount is the number of recovery codes a user is given.
+	RecoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+// TwoFactorEnrollment is returned when a user starts setting up an
+// authenticator app.
+type TwoFactorEnrollment struct {
+	// Secret is the base32 encoded secret for users who type it in by hand.
+	Secret string
+	// URI is the otpauth:// URI that is shown as a QR code.
+	URI string
+}
+
+type TwoFactorService struct {
+	DB           *sql.DB
+	TokenManager *TokenManager
+
+	// EncryptionKey is the AES key used to encrypt TOTP secrets at rest. It
+	// must be 16, 24 or 32 bytes long.
+	EncryptionKey []byte
+	// Issuer is shown in authenticator apps next to the account name.
+	Issuer string
+}
+
+// Begin starts enrolling the user in two-factor authentication by creating a
+// new secret. Two-factor authentication is not enabled until Enable is called
+// with a code generated from the secret.
+func (tfs *TwoFactorService) Begin(userID int, accountName string) (*TwoFactorEnrollment, error) {
+	secretBytes, err := rand.Bytes(totpSecretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("begin two-factor: %w", err)
+	}
+	encrypted, err := tfs.encrypt(secretBytes)
+	if err != nil {
+		return nil, fmt.Errorf("begin two-factor: %w", err)
+	}
+	_, err = tfs.DB.Exec(`
+		UPDATE users
+		SET totp_secret = $2, totp_enabled_at = NULL
+		WHERE id = $1;`, userID, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("begin two-factor: %w", err)
+	}
+	return tfs.enrollment(secretBytes, accountName), nil
+}
+
+// PendingEnrollment returns the enrollment started by Begin so that it can be
+// shown again, for instance after the user mistyped the code. ErrNotFound is
+// returned if there is no enrollment in progress.
+func (tfs *TwoFactorService) PendingEnrollment(userID int, accountName string) (*TwoFactorEnrollment, error) {
+	var encrypted sql.NullString
+	row := tfs.DB.QueryRow(`
+		SELECT totp_secret
+		FROM users WHERE id = $1 AND totp_enabled_at IS NULL;`, userID)
+	err := row.Scan(&encrypted)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("pending enrollment: %w", err)
+	}
+	if !encrypted.Valid {
+		return nil, ErrNotFound
+	}
+	secret, err := tfs.decrypt(encrypted.String)
+	if err != nil {
+		return nil, fmt.Errorf("pending enrollment: %w", err)
+	}
+	return tfs.enrollment(secret, accountName), nil
+}
+
+func (tfs *TwoFactorService) enrollment(secretBytes []byte, accountName string) *TwoFactorEnrollment {
+	issuer := tfs.Issuer
+	if issuer == "" {
+		issuer = "Lenslocked"
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secretBytes)
+	vals := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+	}
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + accountName,
+		RawQuery: vals.Encode(),
+	}
+	return &TwoFactorEnrollment{
+		Secret: secret,
+		URI:    uri.String(),
+	}
+}
+
+// Enable turns on two-factor authentication once the user proves their app is
+// set up by entering a code. It returns a fresh set of recovery codes, which
+// are only ever available in plain text here.
+func (tfs *TwoFactorService) Enable(userID int, code string) ([]string, error) {
+	var encrypted sql.NullString
+	var enabledAt sql.NullTime
+	row := tfs.DB.QueryRow(`
+		SELECT totp_secret, totp_enabled_at
+		FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&encrypted, &enabledAt)
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	if !encrypted.Valid || enabledAt.Valid {
+		return nil, ErrTwoFactorNotPending
+	}
+	secret, err := tfs.decrypt(encrypted.String)
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	step, ok := validateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrTwoFactorCodeInvalid
+	}
+	_, err = tfs.DB.Exec(`
+		UPDATE users
+		SET totp_enabled_at = NOW(), totp_last_step = $2
+		WHERE id = $1;`, userID, step)
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	codes, err := tfs.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		return nil, fmt.Errorf("enable two-factor: %w", err)
+	}
+	return codes, nil
+}
+
+// Disable turns off two-factor authentication and removes the user's secret
+// and recovery codes.
+func (tfs *TwoFactorService) Disable(userID int) error {
+	_, err := tfs.DB.Exec(`
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+		WHERE id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	_, err = tfs.DB.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("disable two-factor: %w", err)
+	}
+	return nil
+}
+
+// Enabled reports whether the user has to enter a second factor to sign in.
+func (tfs *TwoFactorService) Enabled(userID int) (bool, error) {
+	var enabled bool
+	row := tfs.DB.QueryRow(`
+		SELECT totp_enabled_at IS NOT NULL
+		FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&enabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, ErrNotFound
+		}
+		return false, fmt.Errorf("two-factor enabled: %w", err)
+	}
+	return enabled, nil
+}
+
+// Verify checks a code from the user's authenticator app or, failing that,
+// one of their unused recovery codes. A code is only accepted once.
+func (tfs *TwoFactorService) Verify(userID int, code string) error {
+	code = strings.TrimSpace(code)
+	var encrypted sql.NullString
+	row := tfs.DB.QueryRow(`
+		SELECT totp_secret
+		FROM users WHERE id = $1 AND totp_enabled_at IS NOT NULL;`, userID)
+	err := row.Scan(&encrypted)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrTwoFactorCodeInvalid
+		}
+		return fmt.Errorf("verify two-factor: %w", err)
+	}
+	secret, err := tfs.decrypt(encrypted.String)
+	if err != nil {
+		return fmt.Errorf("verify two-factor: %w", err)
+	}
+	if step, ok := validateTOTP(secret, code, time.Now()); ok {
+		// Only accept codes newer than the last one used so that a code seen
+		// over someone's shoulder cannot be replayed.
+		res, err := tfs.DB.Exec(`
+			UPDATE users
+			SET totp_last_step = $2
+			WHERE id = $1 AND totp_last_step < $2;`, userID, step)
+		if err != nil {
+			return fmt.Errorf("verify two-factor: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("verify two-factor: %w", err)
+		}
+		if n == 0 {
+			return ErrTwoFactorCodeInvalid
+		}
+		return nil
+	}
+	return tfs.useRecoveryCode(userID, code)
+}
+
+func (tfs *TwoFactorService) useRecoveryCode(userID int, code string) error {
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return ErrTwoFactorCodeInvalid
+	}
+	res, err := tfs.DB.Exec(`
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`,
+		userID, tfs.tokenManager().Hash(normalized))
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("use recovery code: %w", err)
+	}
+	if n == 0 {
+		return ErrTwoFactorCodeInvalid
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces all of the user's recovery codes. Only the
+// hashes are stored.
+func (tfs *TwoFactorService) RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := tfs.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		DELETE FROM recovery_codes
+		WHERE user_id = $1;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		b, err := rand.Bytes(recoveryCodeBytes)
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES ($1, $2);`, userID, tfs.tokenManager().Hash(code))
+		if err != nil {
+			return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+		}
+		// Shown as two groups of four so they are easier to copy down.
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("regenerate recovery codes: %w", err)
+	}
+	return codes, nil
+}
+
+// RecoveryCodesRemaining returns how many unused recovery codes the user has.
+func (tfs *TwoFactorService) RecoveryCodesRemaining(userID int) (int, error) {
+	var remaining int
+	row := tfs.DB.QueryRow(`
+		SELECT COUNT(*)
+		FROM recovery_codes
+		WHERE user_id = $1 AND used_at IS NULL;`, userID)
+	err := row.Scan(&remaining)
+	if err != nil {
+		return 0, fmt.Errorf("recovery codes remaining: %w", err)
+	}
+	return remaining, nil
+}
+
+func (tfs *TwoFactorService) tokenManager() *TokenManager {
+	if tfs.TokenManager == nil {
+		return &TokenManager{}
+	}
+	return tfs.TokenManager
+}
+
+// encrypt seals the secret with AES-GCM and returns the nonce and ciphertext
+// as a single base64 string.
+func (tfs *TwoFactorService) encrypt(secret []byte) (string, error) {
+	gcm, err := tfs.gcm()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := rand.Bytes(gcm.NonceSize())
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, secret, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (tfs *TwoFactorService) decrypt(encrypted string) ([]byte, error) {
+	gcm, err := tfs.gcm()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("decrypt: ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	secret, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return secret, nil
+}
+
+func (tfs *TwoFactorService) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(tfs.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("two-factor encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// validateTOTP checks the code against the secret for the time periods around
+// now. It returns the time step the code matched.
+func validateTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected := totpCode(secret, step)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode implements the HOTP algorithm from RFC 4226 for the given TOTP
+// time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
@@ -15,10 +16,38 @@ type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// EmailVerifiedAt is nil until the user confirms their email address.
+	EmailVerifiedAt *time.Time
+
+	// Slug is the username in the URL of the user's public profile. It is
+	// empty until the user picks one.
+	Slug        string
+	DisplayName string
+	Bio         string
+	// AvatarKey identifies the user's avatar in the UserService's Store. It
+	// is empty if the user has not uploaded one.
+	AvatarKey string
+}
+
+// Name is the name to show for the user on their profile.
+func (u User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Slug
+}
+
+// EmailVerified reports whether the user has confirmed their email address.
+func (u User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 type UserService struct {
 	DB *sql.DB
+
+	// Store is where avatars are kept. If not set, they are stored on the
+	// local disk in the "images" directory.
+	Store ImageStore
 }
 
 func (us *UserService) Create(email, password string) (*User, error) {
@@ -51,9 +80,9 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 	var user User
 	user.Email = email
 	row := us.DB.QueryRow(`
-    SELECT id, password_hash 
+    SELECT id, password_hash, email_verified_at
     FROM users WHERE email=$1;`, email)
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.EmailVerifiedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNotFound
@@ -71,6 +100,44 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 	return &user, nil
 }
 
+func (us *UserService) ByID(id int) (*User, error) {
+	user := User{
+		ID: id,
+	}
+	var slug, avatarKey sql.NullString
+	row := us.DB.QueryRow(`
+		SELECT email, password_hash, email_verified_at, slug, display_name, bio, avatar_key
+		FROM users WHERE id = $1;`, id)
+	err := row.Scan(&user.Email, &user.PasswordHash, &user.EmailVerifiedAt,
+		&slug, &user.DisplayName, &user.Bio, &avatarKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by id: %w", err)
+	}
+	user.Slug = slug.String
+	user.AvatarKey = avatarKey.String
+	return &user, nil
+}
+
+func (us *UserService) ByEmail(email string) (*User, error) {
+	user := User{
+		Email: strings.ToLower(email),
+	}
+	row := us.DB.QueryRow(`
+		SELECT id, password_hash, email_verified_at
+		FROM users WHERE email = $1;`, user.Email)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.EmailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by email: %w", err)
+	}
+	return &user, nil
+}
+
 func (us *UserService) UpdatePassword(userID int, password string) error {
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -87,13 +154,22 @@ func (us *UserService) UpdatePassword(userID int, password string) error {
 	return nil
 }
 
-func (us *UserService) UpdateEmail(userID int, email string) error {
+// ConfirmEmail sets the user's email address and marks it as verified. It is
+// used once the user has proven they control the address, either the one they
+// signed up with or a new one they changed to.
+func (us *UserService) ConfirmEmail(userID int, email string) error {
 	_, err := us.DB.Exec(`
 	UPDATE users 
-	SET email = $2 
-	WHERE users.id = $1`, userID, email)
+	SET email = $2, email_verified_at = NOW()
+	WHERE users.id = $1`, userID, strings.ToLower(email))
 	if err != nil {
-		return fmt.Errorf("update email: %w", err)
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) {
+			if pgError.Code == pgerrcode.UniqueViolation {
+				return ErrEmailTaken
+			}
+		}
+		return fmt.Errorf("confirm email: %w", err)
 	}
 	return nil
 }